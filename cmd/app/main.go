@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"flag"
 	"log/slog"
 	"os"
 	"os/signal"
@@ -16,6 +17,15 @@ import (
 func main() {
 	cfg := config.MustLoad()
 
+	if args := flag.Args(); len(args) > 0 && args[0] == "migrate" {
+		ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+		ctx = sl.New(ctx, os.Stderr, cfg.Env)
+
+		code := migrate(ctx, cfg, args[1:])
+		cancel()
+		os.Exit(code)
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	ctx = sl.New(ctx, os.Stdout, cfg.Env)
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/AlexMickh/speak-user/internal/config"
+	"github.com/AlexMickh/speak-user/internal/storage/minio"
+	"github.com/AlexMickh/speak-user/internal/storage/mongo"
+	"github.com/AlexMickh/speak-user/pkg/sl"
+)
+
+const migrateUsage = "usage: app [--config=path] migrate up | down [-steps n] | status"
+
+// migrate runs the migrate subcommand and returns the process exit code.
+func migrate(ctx context.Context, cfg *config.Config, args []string) int {
+	if len(args) == 0 || (args[0] != "up" && args[0] != "down" && args[0] != "status") {
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+
+	db, err := mongo.New(ctx, cfg.DB)
+	if err != nil {
+		sl.GetFromCtx(ctx).Error(ctx, "failed to init mongo db", sl.Err(err))
+		return 1
+	}
+	defer db.Close(context.WithoutCancel(ctx))
+
+	migrator := mongo.NewMigrator(db, mongo.Migrations(cfg.Minio.BucketName, minio.DefaultImage))
+
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		if err != nil {
+			sl.GetFromCtx(ctx).Error(ctx, "failed to apply migrations", sl.Err(err))
+			return 1
+		}
+		fmt.Printf("applied %d migration(s)\n", applied)
+	case "down":
+		flags := flag.NewFlagSet("down", flag.ContinueOnError)
+		steps := flags.Int("steps", 1, "number of migrations to revert")
+		if err := flags.Parse(args[1:]); err != nil {
+			return 2
+		}
+
+		reverted, err := migrator.Down(ctx, *steps)
+		if err != nil {
+			sl.GetFromCtx(ctx).Error(ctx, "failed to revert migrations", sl.Err(err))
+			return 1
+		}
+		fmt.Printf("reverted %d migration(s)\n", reverted)
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			sl.GetFromCtx(ctx).Error(ctx, "failed to get migration status", sl.Err(err))
+			return 1
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.AppliedAt != nil {
+				appliedAt = status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", status.Version, status.Name, appliedAt)
+		}
+		w.Flush()
+	}
+
+	return 0
+}
@@ -5,23 +5,43 @@ import (
 	"fmt"
 	"log/slog"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/AlexMickh/speak-protos/pkg/api/user"
+	"github.com/AlexMickh/speak-user/internal/broker/kafka"
+	"github.com/AlexMickh/speak-user/internal/broker/memory"
+	"github.com/AlexMickh/speak-user/internal/broker/nats"
 	"github.com/AlexMickh/speak-user/internal/config"
 	authclient "github.com/AlexMickh/speak-user/internal/grpc/clients/auth"
 	"github.com/AlexMickh/speak-user/internal/grpc/server"
+	"github.com/AlexMickh/speak-user/internal/notifier"
+	"github.com/AlexMickh/speak-user/internal/outbox"
 	"github.com/AlexMickh/speak-user/internal/service"
+	"github.com/AlexMickh/speak-user/internal/storage/cache"
 	"github.com/AlexMickh/speak-user/internal/storage/minio"
 	"github.com/AlexMickh/speak-user/internal/storage/mongo"
+	"github.com/AlexMickh/speak-user/pkg/hasher"
+	"github.com/AlexMickh/speak-user/pkg/imageproc"
+	"github.com/AlexMickh/speak-user/pkg/signedtoken"
 	"github.com/AlexMickh/speak-user/pkg/sl"
 	"google.golang.org/grpc"
 )
 
 type App struct {
 	db         *mongo.Storage
+	migrator   *mongo.Migrator
 	cfg        *config.Config
 	server     *grpc.Server
+	service    *service.Service
 	authClient *authclient.AuthClient
+	tokenCache *authclient.CachedClient
+	queue      *notifier.Queue
+	relay      *outbox.Relay
+	broker     outbox.Broker
+	cache      cache.Cache
+	stop       context.CancelFunc
+	workers    sync.WaitGroup
 }
 
 func Register(ctx context.Context, cfg *config.Config) *App {
@@ -37,31 +57,126 @@ func Register(ctx context.Context, cfg *config.Config) *App {
 		sl.GetFromCtx(ctx).Fatal(ctx, "failed to init mongo db", sl.Err(err))
 	}
 
+	migrator := mongo.NewMigrator(db, mongo.Migrations(cfg.Minio.BucketName, minio.DefaultImage))
+	if cfg.DB.AutoMigrate {
+		// ctx only bounds connecting. Migrations over a big collection, or
+		// waiting for another replica that is running them, take longer.
+		migrateCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cfg.DB.MigrateTimeout)
+		applied, err := migrator.Up(migrateCtx)
+		cancel()
+		if err != nil {
+			sl.GetFromCtx(ctx).Fatal(ctx, "failed to migrate mongo db", sl.Err(err))
+		}
+		if applied > 0 {
+			sl.GetFromCtx(ctx).Info(ctx, "applied migrations", slog.Int("count", applied))
+		}
+	}
+
+	sl.GetFromCtx(ctx).Info(ctx, "initing cache", slog.String("backend", cfg.Cache.Backend))
+	userCache, err := newCache(ctx, cfg)
+	if err != nil {
+		sl.GetFromCtx(ctx).Fatal(ctx, "failed to init cache", sl.Err(err))
+	}
+	var users service.DB = db
+	if userCache != nil {
+		users = cache.NewDB(db, userCache, cfg.Cache.TTL, cfg.Cache.NegativeTTL)
+	}
+
 	sl.GetFromCtx(ctx).Info(ctx, "initing minio")
-	minio, err := minio.New(ctx, cfg.Minio)
+	minio, err := minio.New(ctx, cfg.Minio, cfg.Export.Secret != "")
 	if err != nil {
 		sl.GetFromCtx(ctx).Fatal(ctx, "failed to init minio", sl.Err(err))
 	}
 
 	sl.GetFromCtx(ctx).Info(ctx, "initing service")
-	service := service.New(db, minio)
+	argon := hasher.New(hasher.Params{
+		Memory:      cfg.Hasher.Memory,
+		Iterations:  cfg.Hasher.Iterations,
+		Parallelism: cfg.Hasher.Parallelism,
+		SaltLength:  cfg.Hasher.SaltLength,
+		KeyLength:   cfg.Hasher.KeyLength,
+	})
+	var passwordHasher service.Hasher = argon
+	if !cfg.Hasher.Enabled {
+		passwordHasher = hasher.Plaintext{Hasher: argon}
+	}
+	imageProcessor := imageproc.New(cfg.Image.MaxSize, cfg.Image.MaxPixels, cfg.Image.Sizes)
+	signer := signedtoken.New(cfg.Verification.Secret)
+	if cfg.Verification.Secret == "" {
+		sl.GetFromCtx(ctx).Info(ctx, "verification secret is not set, email verification is disabled")
+	}
+
+	sl.GetFromCtx(ctx).Info(ctx, "initing notifier", slog.String("sink", cfg.Notifier.Sink))
+	sender, err := newSender(cfg.Notifier)
+	if err != nil {
+		sl.GetFromCtx(ctx).Fatal(ctx, "failed to init notification sender", sl.Err(err))
+	}
+	templates, err := notifier.NewTemplates(cfg.Notifier.Locale)
+	if err != nil {
+		sl.GetFromCtx(ctx).Fatal(ctx, "failed to load notification templates", sl.Err(err))
+	}
+	queue := notifier.NewQueue(sender, cfg.Notifier.QueueSize, cfg.Notifier.MaxAttempts, cfg.Notifier.RetryDelay)
+	queue.Start(ctx, cfg.Notifier.Workers)
+	notifier := notifier.New(templates, queue, cfg.Notifier.BaseURL)
+
+	service := service.New(
+		users,
+		minio,
+		passwordHasher,
+		imageProcessor,
+		signer,
+		notifier,
+		cfg.Verification,
+		cfg.Users,
+		cfg.Export,
+	)
+
+	sl.GetFromCtx(ctx).Info(ctx, "initing outbox relay", slog.String("broker", cfg.Outbox.Broker))
+	broker, err := newBroker(cfg.Outbox)
+	if err != nil {
+		sl.GetFromCtx(ctx).Fatal(ctx, "failed to init broker", sl.Err(err))
+	}
+	relay := outbox.NewRelay(db, broker, cfg.Outbox.BatchSize, cfg.Outbox.PublishTimeout)
 
 	sl.GetFromCtx(ctx).Info(ctx, "initing auth client")
-	authClient, err := authclient.New(cfg.AuthServiceAddr)
+	authClient, err := authclient.New(cfg.AuthClient)
 	if err != nil {
 		sl.GetFromCtx(ctx).Fatal(ctx, "failed to init auth client", sl.Err(err))
 	}
 
 	sl.GetFromCtx(ctx).Info(ctx, "initing server")
-	srv := server.New(service, authClient)
-	server := grpc.NewServer(grpc.UnaryInterceptor(sl.Interceptor(ctx)))
+	srv := server.New(service)
+	tokenCache := authclient.NewCached(authClient, cfg.AuthCache.Size, cfg.AuthCache.TTL)
+	if cfg.EnforceInternalToken && cfg.InternalToken == "" {
+		sl.GetFromCtx(ctx).Fatal(ctx, "INTERNAL_TOKEN_ENFORCE needs INTERNAL_SERVICE_TOKEN")
+	}
+	if !cfg.EnforceInternalToken {
+		sl.GetFromCtx(ctx).Info(ctx, "internal token is not enforced, internal methods accept callers without it")
+	}
+	auth := server.NewAuth(tokenCache, cfg.InternalToken, cfg.EnforceInternalToken, server.Policies)
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(
+			sl.Interceptor(ctx),
+			server.ErrorInterceptor(),
+			auth.UnaryInterceptor(),
+			server.LanguageInterceptor(),
+		),
+		grpc.ChainStreamInterceptor(auth.StreamInterceptor()),
+	)
 	user.RegisterUserServer(server, srv)
 
 	return &App{
 		db:         db,
+		migrator:   migrator,
 		cfg:        cfg,
 		server:     server,
+		service:    service,
 		authClient: authClient,
+		tokenCache: tokenCache,
+		queue:      queue,
+		relay:      relay,
+		broker:     broker,
+		cache:      userCache,
 	}
 }
 
@@ -84,10 +199,173 @@ func (a *App) Run(ctx context.Context) {
 	}()
 
 	sl.GetFromCtx(ctx).Info(ctx, "server started", slog.Int("port", a.cfg.Port))
+
+	// ctx only bounds startup, workers live until GracefulStop.
+	workerCtx, stop := context.WithCancel(context.WithoutCancel(ctx))
+	a.stop = stop
+
+	a.runWorker(workerCtx, "image gc", a.cfg.Image.GCInterval, func(ctx context.Context) error {
+		// Until the image key migration has run, legacy avatars are only
+		// referenced by url and would look like orphans.
+		pending, err := a.migrator.Pending(ctx)
+		if err != nil {
+			return err
+		}
+		if pending > 0 {
+			sl.GetFromCtx(ctx).Info(ctx, "skipping image gc, migrations are pending", slog.Int("pending", pending))
+			return nil
+		}
+
+		deleted, err := a.service.CollectOrphanImages(ctx, a.cfg.Image.GCGracePeriod)
+		if deleted > 0 {
+			sl.GetFromCtx(ctx).Info(ctx, "deleted orphan images", slog.Int("count", deleted))
+		}
+		return err
+	})
+
+	a.runWorker(workerCtx, "avatar processing", a.cfg.Image.ProcessInterval, func(ctx context.Context) error {
+		processed, err := a.service.ProcessOriginalAvatars(ctx)
+		if processed > 0 {
+			sl.GetFromCtx(ctx).Info(ctx, "processed original avatars", slog.Int("count", processed))
+		}
+		return err
+	})
+
+	a.runWorker(workerCtx, "token cache stats", a.cfg.AuthCache.StatsInterval, func(ctx context.Context) error {
+		a.logTokenCacheStats(ctx)
+		return nil
+	})
+
+	a.runWorker(workerCtx, "user purge", a.cfg.Users.PurgeInterval, func(ctx context.Context) error {
+		purged, err := a.service.PurgeDeletedUsers(ctx)
+		if purged > 0 {
+			sl.GetFromCtx(ctx).Info(ctx, "purged deleted users", slog.Int("count", purged))
+		}
+		return err
+	})
+
+	a.runWorker(workerCtx, "data export", a.cfg.Export.Interval, func(ctx context.Context) error {
+		done, err := a.service.RunExportJobs(ctx)
+		if done > 0 {
+			sl.GetFromCtx(ctx).Info(ctx, "finished data exports", slog.Int("count", done))
+		}
+		return err
+	})
+
+	a.runWorker(workerCtx, "outbox relay", a.cfg.Outbox.Interval, func(ctx context.Context) error {
+		_, err := a.relay.Relay(ctx)
+		return err
+	})
+}
+
+// runWorker calls fn every interval until ctx is cancelled.
+func (a *App) runWorker(ctx context.Context, name string, interval time.Duration, fn func(ctx context.Context) error) {
+	ctx = sl.GetFromCtx(ctx).With(ctx, slog.String("worker", name))
+
+	a.workers.Add(1)
+	go func() {
+		defer a.workers.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := fn(ctx); err != nil {
+					sl.GetFromCtx(ctx).Error(ctx, "worker failed", sl.Err(err))
+				}
+			}
+		}
+	}()
 }
 
 func (a *App) GracefulStop(ctx context.Context) {
 	a.server.GracefulStop()
+
+	if a.stop != nil {
+		a.stop()
+	}
+	a.workers.Wait()
+
+	// ctx may be long done by now, it only carries the logger.
+	closeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), a.cfg.Notifier.ShutdownTimeout)
+	defer cancel()
+	if err := a.queue.Close(closeCtx); err != nil {
+		sl.GetFromCtx(ctx).Error(ctx, "failed to deliver queued notifications", sl.Err(err))
+	}
+	if err := a.broker.Close(); err != nil {
+		sl.GetFromCtx(ctx).Error(ctx, "failed to close broker", sl.Err(err))
+	}
+
+	a.logTokenCacheStats(ctx)
+
+	if a.cache != nil {
+		if err := a.cache.Close(); err != nil {
+			sl.GetFromCtx(ctx).Error(ctx, "failed to close cache", sl.Err(err))
+		}
+	}
+
 	a.authClient.Close()
 	a.db.Close(ctx)
 }
+
+func newSender(cfg config.NotifierConfig) (notifier.Sender, error) {
+	switch cfg.Sink {
+	case "smtp":
+		return notifier.NewSMTP(cfg.SMTP), nil
+	case "file":
+		return notifier.NewFile(cfg.FilePath)
+	case "stdout":
+		return notifier.NewStdout(), nil
+	default:
+		return nil, fmt.Errorf("unknown notifier sink %q", cfg.Sink)
+	}
+}
+
+func newBroker(cfg config.OutboxConfig) (outbox.Broker, error) {
+	switch cfg.Broker {
+	case "nats":
+		return nats.New(cfg.NatsURL, cfg.NatsSubjectPrefix, cfg.NatsStream)
+	case "kafka":
+		return kafka.New(cfg.KafkaBrokers, cfg.KafkaTopic), nil
+	case "memory":
+		return memory.New(), nil
+	default:
+		return nil, fmt.Errorf("unknown outbox broker %q", cfg.Broker)
+	}
+}
+
+// logTokenCacheStats logs the hit and miss counts of the token cache
+// since startup.
+func (a *App) logTokenCacheStats(ctx context.Context) {
+	stats := a.tokenCache.Stats()
+	sl.GetFromCtx(ctx).Info(ctx, "token cache stats",
+		slog.Uint64("hits", stats.Hits),
+		slog.Uint64("misses", stats.Misses),
+		slog.Float64("hit_rate", stats.HitRate()),
+		slog.Int("size", stats.Size),
+	)
+}
+
+// newCache returns nil when caching is turned off or redis is
+// unreachable, the cache is an optimisation and mustn't block startup.
+func newCache(ctx context.Context, cfg *config.Config) (cache.Cache, error) {
+	switch cfg.Cache.Backend {
+	case "redis":
+		redis, err := cache.NewRedis(ctx, cfg.Redis)
+		if err != nil {
+			sl.GetFromCtx(ctx).Error(ctx, "failed to connect to redis, running without cache", sl.Err(err))
+			return nil, nil
+		}
+		return redis, nil
+	case "memory":
+		return cache.NewMemory(), nil
+	case "none":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown cache backend %q", cfg.Cache.Backend)
+	}
+}
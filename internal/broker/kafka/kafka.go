@@ -0,0 +1,54 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/AlexMickh/speak-user/internal/domain/models"
+	"github.com/segmentio/kafka-go"
+)
+
+// Broker writes events to a single topic keyed by user id, so the events
+// of one user stay ordered within a partition.
+type Broker struct {
+	writer *kafka.Writer
+}
+
+func New(brokers []string, topic string) *Broker {
+	return &Broker{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(brokers...),
+			Topic:        topic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+		},
+	}
+}
+
+func (b *Broker) Publish(ctx context.Context, event models.Event) error {
+	const op = "broker.kafka.Publish"
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	err = b.writer.WriteMessages(ctx, kafka.Message{
+		Key:   []byte(event.UserID.String()),
+		Value: data,
+		Headers: []kafka.Header{
+			{Key: "event_id", Value: []byte(event.ID.String())},
+			{Key: "event_type", Value: []byte(event.Type)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+func (b *Broker) Close() error {
+	return b.writer.Close()
+}
@@ -0,0 +1,43 @@
+package memory
+
+import (
+	"context"
+	"sync"
+
+	"github.com/AlexMickh/speak-user/internal/domain/models"
+)
+
+// Broker keeps published events in memory. It is meant for tests and local
+// runs without a message broker.
+type Broker struct {
+	mu     sync.Mutex
+	events []models.Event
+}
+
+func New() *Broker {
+	return &Broker{}
+}
+
+func (b *Broker) Publish(ctx context.Context, event models.Event) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.events = append(b.events, event)
+
+	return nil
+}
+
+// Events returns a copy of everything published so far.
+func (b *Broker) Events() []models.Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	events := make([]models.Event, len(b.events))
+	copy(events, b.events)
+
+	return events
+}
+
+func (b *Broker) Close() error {
+	return nil
+}
@@ -0,0 +1,106 @@
+package nats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/AlexMickh/speak-user/internal/domain/models"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Broker publishes every event on "<prefix>.<event type>" through
+// JetStream. Publish returns only once the stream acknowledged the event,
+// and the event id is sent as Nats-Msg-Id, which JetStream uses to drop
+// redelivered duplicates.
+type Broker struct {
+	conn   *nats.Conn
+	js     jetstream.JetStream
+	prefix string
+	stream string
+
+	mu          sync.Mutex
+	streamReady bool
+}
+
+// New connects to NATS. The server may still be down, the connection is
+// retried in the background.
+func New(url string, prefix string, stream string) (*Broker, error) {
+	const op = "broker.nats.New"
+
+	conn, err := nats.Connect(url, nats.RetryOnFailedConnect(true), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	js, err := jetstream.New(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return &Broker{
+		conn:   conn,
+		js:     js,
+		prefix: prefix,
+		stream: stream,
+	}, nil
+}
+
+func (b *Broker) Publish(ctx context.Context, event models.Event) error {
+	const op = "broker.nats.Publish"
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := b.ensureStream(ctx); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	msg := nats.NewMsg(b.prefix + "." + event.Type)
+	msg.Header.Set(nats.MsgIdHdr, event.ID.String())
+	msg.Data = data
+
+	_, err = b.js.PublishMsg(ctx, msg)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// ensureStream makes sure a stream captures the events before the first
+// publish, without one JetStream would not acknowledge them. An existing
+// stream is used as it is, otherwise one is created for "<prefix>.>".
+func (b *Broker) ensureStream(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.streamReady {
+		return nil
+	}
+
+	_, err := b.js.Stream(ctx, b.stream)
+	if errors.Is(err, jetstream.ErrStreamNotFound) {
+		_, err = b.js.CreateStream(ctx, jetstream.StreamConfig{
+			Name:     b.stream,
+			Subjects: []string{b.prefix + ".>"},
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	b.streamReady = true
+
+	return nil
+}
+
+func (b *Broker) Close() error {
+	return b.conn.Drain()
+}
@@ -4,42 +4,186 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/ilyakaznacheev/cleanenv"
 )
 
 type Config struct {
-	Env             string `env:"ENV" env-default:"prod"`
-	Port            int    `env:"PORT" env-default:"50055"`
-	AuthServiceAddr string `env:"AUTH_SERVICE_ADDR" env-required:"true"`
-	DB              DBConfig
-	Minio           MinioConfig
-	// Redis           RedisConfig `env:"REDIS"`
+	Env           string `env:"ENV" env-default:"prod"`
+	Port          int    `env:"PORT" env-default:"50055"`
+	InternalToken string `env:"INTERNAL_SERVICE_TOKEN"`
+	AuthClient    AuthClientConfig
+	AuthCache     AuthCacheConfig
+	DB            DBConfig
+	Minio         MinioConfig
+	Image         ImageConfig
+	Hasher        HasherConfig
+	Verification  VerificationConfig
+	Notifier      NotifierConfig
+	Outbox        OutboxConfig
+	Users         UsersConfig
+	Export        ExportConfig
+	Cache         CacheConfig
+	Redis         RedisConfig
+	// EnforceInternalToken rejects internal-only calls that come without
+	// InternalToken. Until then only a wrong token is rejected, so callers
+	// that don't send one yet keep working.
+	EnforceInternalToken bool `env:"INTERNAL_TOKEN_ENFORCE" env-default:"false"`
 }
 
+// DBConfig points at MongoDB. The server must be a replica set member or a
+// mongos, since user writes run in transactions.
 type DBConfig struct {
-	Host       string `env:"DB_HOST" env-default:"localhost"`
-	Port       int    `env:"DB_PORT" env-default:"27017"`
-	User       string `env:"DB_USER" env-default:"mongo"`
-	Password   string `env:"DB_PASSWORD" env-required:"true"`
-	Database   string `env:"DB_DATABASE" env-default:"users"`
-	Collection string `env:"DB_COLLECTION" env-default:"users"`
+	Host              string `env:"DB_HOST" env-default:"localhost"`
+	Port              int    `env:"DB_PORT" env-default:"27017"`
+	User              string `env:"DB_USER" env-default:"mongo"`
+	Password          string `env:"DB_PASSWORD" env-required:"true"`
+	Database          string `env:"DB_DATABASE" env-default:"users"`
+	Collection        string `env:"DB_COLLECTION" env-default:"users"`
+	TokensCollection  string `env:"DB_TOKENS_COLLECTION" env-default:"verification_tokens"`
+	OutboxCollection  string `env:"DB_OUTBOX_COLLECTION" env-default:"outbox"`
+	ExportsCollection string `env:"DB_EXPORTS_COLLECTION" env-default:"exports"`
+	// DirectConnection talks to Host only instead of discovering the other
+	// replica set members, for a single node set whose advertised host is
+	// not reachable from the service.
+	DirectConnection bool `env:"DB_DIRECT_CONNECTION" env-default:"false"`
+	// AutoMigrate applies pending migrations on startup, giving them up to
+	// MigrateTimeout.
+	AutoMigrate    bool          `env:"DB_AUTO_MIGRATE" env-default:"true"`
+	MigrateTimeout time.Duration `env:"DB_MIGRATE_TIMEOUT" env-default:"1h"`
 }
 
 type MinioConfig struct {
-	Endpoint   string `env:"MINIO_ENDPOINT" env-default:"localhost:9000"`
-	User       string `env:"MINIO_ROOT_USER" env-default:"minio"`
-	Password   string `env:"MINIO_ROOT_PASSWORD" env-required:"true"`
-	BucketName string `env:"MINIO_BUCKET_NAME" env-default:"users"`
-	IsUseSsl   bool   `env:"MINIO_USE_SSL" env-default:"false"`
-}
-
-// type RedisConfig struct {
-// 	Addr     string `env:"REDIS_ADDR" env-default:"localhost:6379"`
-// 	User     string `env:"REDIS_USER" env-default:"root"`
-// 	Password string `env:"REDIS_USER_PASSWORD" env-default:"root"`
-// 	DB       int    `env:"REDIS_DB" env-default:"0"`
-// }
+	Endpoint         string        `env:"MINIO_ENDPOINT" env-default:"localhost:9000"`
+	User             string        `env:"MINIO_ROOT_USER" env-default:"minio"`
+	Password         string        `env:"MINIO_ROOT_PASSWORD" env-required:"true"`
+	BucketName       string        `env:"MINIO_BUCKET_NAME" env-default:"users"`
+	IsUseSsl         bool          `env:"MINIO_USE_SSL" env-default:"false"`
+	UploadTTL        time.Duration `env:"MINIO_UPLOAD_TTL" env-default:"15m"`
+	ExportBucketName string        `env:"MINIO_EXPORT_BUCKET_NAME" env-default:"exports"`
+	ExportUrlTTL     time.Duration `env:"MINIO_EXPORT_URL_TTL" env-default:"24h"`
+	// ExportRetentionDays is how long export archives are kept in the bucket.
+	ExportRetentionDays int `env:"MINIO_EXPORT_RETENTION_DAYS" env-default:"7"`
+}
+
+type AuthClientConfig struct {
+	Addr            string        `env:"AUTH_SERVICE_ADDR" env-required:"true"`
+	Timeout         time.Duration `env:"AUTH_CLIENT_TIMEOUT" env-default:"2s"`
+	MaxAttempts     int           `env:"AUTH_CLIENT_MAX_ATTEMPTS" env-default:"3"`
+	BreakerFailures uint32        `env:"AUTH_CLIENT_BREAKER_FAILURES" env-default:"5"`
+	BreakerTimeout  time.Duration `env:"AUTH_CLIENT_BREAKER_TIMEOUT" env-default:"30s"`
+}
+
+type AuthCacheConfig struct {
+	Size int           `env:"AUTH_CACHE_SIZE" env-default:"10000"`
+	TTL  time.Duration `env:"AUTH_CACHE_TTL" env-default:"1m"`
+
+	// StatsInterval is how often the cache hit and miss counts are logged.
+	StatsInterval time.Duration `env:"AUTH_CACHE_STATS_INTERVAL" env-default:"5m"`
+}
+
+type ImageConfig struct {
+	MaxSize       int64         `env:"IMAGE_MAX_SIZE" env-default:"5242880"`
+	MaxPixels     int           `env:"IMAGE_MAX_PIXELS" env-default:"25000000"`
+	Sizes         []int         `env:"IMAGE_SIZES" env-default:"64,256,512"`
+	GCInterval    time.Duration `env:"IMAGE_GC_INTERVAL" env-default:"1h"`
+	GCGracePeriod time.Duration `env:"IMAGE_GC_GRACE_PERIOD" env-default:"1h"`
+	// ProcessInterval is how often avatars still stored as uploaded are
+	// looked for and processed.
+	ProcessInterval time.Duration `env:"IMAGE_PROCESS_INTERVAL" env-default:"1m"`
+}
+
+type VerificationConfig struct {
+	// Secret signs email verification and email change tokens. Without it
+	// no tokens are issued and both flows are disabled.
+	Secret         string        `env:"VERIFICATION_SECRET"`
+	TTL            time.Duration `env:"VERIFICATION_TTL" env-default:"24h"`
+	ResendCooldown time.Duration `env:"VERIFICATION_RESEND_COOLDOWN" env-default:"1m"`
+}
+
+// NotifierConfig sets up account emails. Locale is the language used when
+// the recipient's languages are unknown or have no templates.
+type NotifierConfig struct {
+	// Sink is one of smtp, file or stdout.
+	Sink        string        `env:"NOTIFIER_SINK" env-default:"stdout"`
+	FilePath    string        `env:"NOTIFIER_FILE_PATH" env-default:"notifications.log"`
+	Locale      string        `env:"NOTIFIER_LOCALE" env-default:"en"`
+	BaseURL     string        `env:"NOTIFIER_BASE_URL" env-default:"http://localhost:3000"`
+	QueueSize   int           `env:"NOTIFIER_QUEUE_SIZE" env-default:"1000"`
+	Workers     int           `env:"NOTIFIER_WORKERS" env-default:"2"`
+	MaxAttempts int           `env:"NOTIFIER_MAX_ATTEMPTS" env-default:"5"`
+	RetryDelay  time.Duration `env:"NOTIFIER_RETRY_DELAY" env-default:"2s"`
+	// ShutdownTimeout bounds how long shutdown waits for queued messages.
+	ShutdownTimeout time.Duration `env:"NOTIFIER_SHUTDOWN_TIMEOUT" env-default:"10s"`
+	SMTP            SMTPConfig
+}
+
+type SMTPConfig struct {
+	Host     string `env:"SMTP_HOST" env-default:"localhost"`
+	Port     int    `env:"SMTP_PORT" env-default:"587"`
+	User     string `env:"SMTP_USER"`
+	Password string `env:"SMTP_PASSWORD"`
+	From     string `env:"SMTP_FROM" env-default:"no-reply@speak.local"`
+	// Timeout bounds a whole delivery, from dialing to QUIT.
+	Timeout time.Duration `env:"SMTP_TIMEOUT" env-default:"30s"`
+}
+
+type OutboxConfig struct {
+	// Broker is one of nats, kafka or memory.
+	Broker            string        `env:"OUTBOX_BROKER" env-default:"nats"`
+	Interval          time.Duration `env:"OUTBOX_INTERVAL" env-default:"1s"`
+	BatchSize         int           `env:"OUTBOX_BATCH_SIZE" env-default:"100"`
+	PublishTimeout    time.Duration `env:"OUTBOX_PUBLISH_TIMEOUT" env-default:"5s"`
+	NatsURL           string        `env:"NATS_URL" env-default:"nats://localhost:4222"`
+	NatsSubjectPrefix string        `env:"NATS_SUBJECT_PREFIX" env-default:"speak.user"`
+	NatsStream        string        `env:"NATS_STREAM" env-default:"SPEAK_USER"`
+	KafkaBrokers      []string      `env:"KAFKA_BROKERS" env-default:"localhost:9092"`
+	KafkaTopic        string        `env:"KAFKA_TOPIC" env-default:"speak.user.events"`
+}
+
+type UsersConfig struct {
+	BatchMaxSize       int           `env:"USERS_BATCH_MAX_SIZE" env-default:"100"`
+	SearchDefaultLimit int           `env:"USERS_SEARCH_DEFAULT_LIMIT" env-default:"20"`
+	SearchMaxLimit     int           `env:"USERS_SEARCH_MAX_LIMIT" env-default:"50"`
+	RenameCooldown     time.Duration `env:"USERS_RENAME_COOLDOWN" env-default:"720h"`
+	DeleteGracePeriod  time.Duration `env:"USERS_DELETE_GRACE_PERIOD" env-default:"720h"`
+	PurgeInterval      time.Duration `env:"USERS_PURGE_INTERVAL" env-default:"1h"`
+}
+
+type ExportConfig struct {
+	// Secret signs the manifest of every export archive. Without it data
+	// exports are disabled.
+	Secret   string        `env:"EXPORT_SIGNING_SECRET"`
+	Interval time.Duration `env:"EXPORT_INTERVAL" env-default:"10s"`
+}
+
+type HasherConfig struct {
+	Memory      uint32 `env:"HASHER_MEMORY" env-default:"65536"`
+	Iterations  uint32 `env:"HASHER_ITERATIONS" env-default:"1"`
+	Parallelism uint8  `env:"HASHER_PARALLELISM" env-default:"4"`
+	SaltLength  uint32 `env:"HASHER_SALT_LENGTH" env-default:"16"`
+	KeyLength   uint32 `env:"HASHER_KEY_LENGTH" env-default:"32"`
+	// Enabled stores new passwords as argon2id hashes. It stays off until
+	// speak-auth verifies passwords through this service instead of
+	// comparing the Password returned by GetUser.
+	Enabled bool `env:"HASHER_ENABLED" env-default:"false"`
+}
+
+type CacheConfig struct {
+	// Backend is one of redis, memory or none. If redis can't be reached
+	// at startup the service runs without a cache.
+	Backend     string        `env:"CACHE_BACKEND" env-default:"none"`
+	TTL         time.Duration `env:"CACHE_TTL" env-default:"1m"`
+	NegativeTTL time.Duration `env:"CACHE_NEGATIVE_TTL" env-default:"10s"`
+}
+
+type RedisConfig struct {
+	Addr     string `env:"REDIS_ADDR" env-default:"localhost:6379"`
+	User     string `env:"REDIS_USER"`
+	Password string `env:"REDIS_USER_PASSWORD"`
+	DB       int    `env:"REDIS_DB" env-default:"0"`
+}
 
 func MustLoad() *Config {
 	path := fetchPath()
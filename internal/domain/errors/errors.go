@@ -0,0 +1,32 @@
+package errors
+
+import "errors"
+
+var (
+	ErrUserNotFound       = errors.New("user not found")
+	ErrVersionConflict    = errors.New("user was changed concurrently")
+	ErrEmailTaken         = errors.New("email is already taken")
+	ErrInvalidEmail       = errors.New("invalid email")
+	ErrUsernameTaken      = errors.New("username is already taken")
+	ErrInvalidUsername    = errors.New("invalid username")
+	ErrUsernameReserved   = errors.New("username is reserved")
+	ErrRenameCooldown     = errors.New("username was changed too recently")
+	ErrInvalidID          = errors.New("invalid id")
+	ErrImageTooLarge      = errors.New("image is too large")
+	ErrInvalidImage       = errors.New("invalid image")
+	ErrChecksumMismatch   = errors.New("checksum mismatch")
+	ErrUploadNotFound     = errors.New("upload not found")
+	ErrExportNotFound     = errors.New("export not found")
+	ErrExportDisabled     = errors.New("data export is disabled")
+	ErrTokensDisabled     = errors.New("email verification is disabled")
+	ErrTokenNotFound      = errors.New("token not found")
+	ErrTokenExpired       = errors.New("token is expired")
+	ErrTokenUsed          = errors.New("token is already used")
+	ErrEmailVerified      = errors.New("email is already verified")
+	ErrTooManyRequests    = errors.New("too many requests")
+	ErrInvalidResumeToken = errors.New("invalid resume token")
+	ErrBatchTooLarge      = errors.New("batch is too large")
+	ErrInvalidCursor      = errors.New("invalid cursor")
+	ErrInvalidFieldMask   = errors.New("invalid field mask")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
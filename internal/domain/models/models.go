@@ -1,6 +1,9 @@
 package models
 
 import (
+	"encoding/json"
+	"time"
+
 	"github.com/google/uuid"
 )
 
@@ -9,14 +12,169 @@ type User struct {
 	Email           string    `bson:"email"`
 	Username        *string   `bson:"username,omitempty"`
 	Password        string    `bson:"password"`
-	Description     *string   `bson:"description,omitempy"`
+	Description     *string   `bson:"description,omitempty"`
 	ProfileImageUrl *string   `bson:"profile_image_url,omitempty"`
-	IsEmailVerified bool      `bson:"is_email_verified"`
-	CreatedAt       int64     `bson:"created_at"`
-	UpdatedAt       int64     `bson:"updated_at"`
+	// ProfileImages maps the side of each avatar variant to its object key.
+	ProfileImages   map[string]string `bson:"profile_images,omitempty"`
+	IsEmailVerified bool              `bson:"is_email_verified"`
+	CreatedAt       int64             `bson:"created_at"`
+	UpdatedAt       int64             `bson:"updated_at"`
+	// UsernameNormalized is the uniqueness key of Username, see the
+	// username package.
+	UsernameNormalized string `bson:"username_normalized,omitempty"`
+	UsernameChangedAt  int64  `bson:"username_changed_at,omitempty"`
+	// DeletedAt is set while the user is soft deleted.
+	DeletedAt int64 `bson:"deleted_at,omitempty"`
+	// Version grows with every change of the profile. Users created before
+	// versioning have none, which reads as 0.
+	Version int64 `bson:"version"`
+}
+
+// Fields of a user that a profile update may name in its field mask.
+const (
+	UserFieldUsername     = "username"
+	UserFieldDescription  = "description"
+	UserFieldProfileImage = "profileImage"
+)
+
+// UserUpdate holds the fields to change on a user. Nil fields are kept and
+// the document fields listed in Unset are removed. When ExpectedVersion is
+// set, the update only applies to that version. KeepVersion is for
+// changes the system makes on its own, which clients shouldn't see as a
+// conflicting edit.
+type UserUpdate struct {
+	ExpectedVersion    *int64            `bson:"-"`
+	KeepVersion        bool              `bson:"-"`
+	Unset              []string          `bson:"-"`
+	Username           *string           `bson:"username,omitempty"`
+	UsernameNormalized *string           `bson:"username_normalized,omitempty"`
+	UsernameChangedAt  *int64            `bson:"username_changed_at,omitempty"`
+	Description        *string           `bson:"description,omitempty"`
+	ProfileImages      map[string]string `bson:"profile_images,omitempty"`
+	UpdatedAt          int64             `bson:"updated_at,omitempty"`
+}
+
+// PublicProfile is the part of a user anyone may see. AvatarUrls maps the
+// side of each avatar variant to a presigned url.
+type PublicProfile struct {
+	ID            uuid.UUID         `bson:"_id"`
+	Username      *string           `bson:"username,omitempty"`
+	Description   *string           `bson:"description,omitempty"`
+	ProfileImages map[string]string `bson:"profile_images,omitempty"`
+	AvatarUrls    map[string]string `bson:"-"`
+	CreatedAt     int64             `bson:"created_at"`
+}
+
+// SearchCursor points at the last user of a search page. The next page
+// starts right after it.
+type SearchCursor struct {
+	Username string    `json:"username"`
+	ID       uuid.UUID `json:"id"`
 }
 
 type Image struct {
 	ID   uuid.UUID
 	Data []byte
 }
+
+type StoredImage struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	LastModified time.Time
+}
+
+// PresignedUpload lets a client POST an avatar straight to storage.
+// FormData must be sent along with the file as multipart form fields.
+type PresignedUpload struct {
+	Key       string
+	Url       string
+	FormData  map[string]string
+	ExpiresAt time.Time
+}
+
+// AvatarUpload describes a streamed avatar before its data arrives.
+// Checksum is the hex encoded sha256 of the whole image.
+type AvatarUpload struct {
+	ContentType string
+	Size        int64
+	Checksum    string
+}
+
+const (
+	TokenPurposeEmailVerification = "email_verification"
+	TokenPurposeEmailChange       = "email_change"
+)
+
+// VerificationToken is stored by hash only. Dates are kept as time.Time,
+// unlike on User, because the TTL index needs them as BSON dates.
+type VerificationToken struct {
+	Hash      string     `bson:"_id"`
+	UserID    uuid.UUID  `bson:"user_id"`
+	Purpose   string     `bson:"purpose"`
+	Email     string     `bson:"email"`
+	CreatedAt time.Time  `bson:"created_at"`
+	ExpiresAt time.Time  `bson:"expires_at"`
+	UsedAt    *time.Time `bson:"used_at,omitempty"`
+}
+
+const (
+	EventUserCreated    = "user.created"
+	EventEmailVerified  = "user.email_verified"
+	EventProfileUpdated = "user.profile_updated"
+	EventUserDeleted    = "user.deleted"
+	EventUserRestored   = "user.restored"
+)
+
+// Event is a domain event waiting in the outbox. Payload is the JSON
+// encoded body specific to Type.
+type Event struct {
+	ID          uuid.UUID       `bson:"_id" json:"id"`
+	Type        string          `bson:"type" json:"type"`
+	UserID      uuid.UUID       `bson:"user_id" json:"user_id"`
+	Payload     json.RawMessage `bson:"payload" json:"payload"`
+	CreatedAt   time.Time       `bson:"created_at" json:"created_at"`
+	PublishedAt *time.Time      `bson:"published_at,omitempty" json:"-"`
+}
+
+const (
+	ChangeCreated = "created"
+	ChangeUpdated = "updated"
+	ChangeDeleted = "deleted"
+)
+
+// UserChange is one entry of the user change feed. User is nil for
+// deletions and never carries the password. ResumeToken lets a client
+// continue the feed right after this change.
+type UserChange struct {
+	Operation   string
+	UserID      uuid.UUID
+	User        *User
+	ResumeToken string
+}
+
+// DataExport points at a ready personal data archive.
+type DataExport struct {
+	Url       string
+	ExpiresAt time.Time
+}
+
+const (
+	ExportPending = "pending"
+	ExportRunning = "running"
+	ExportDone    = "done"
+	ExportFailed  = "failed"
+	// ExportExpired is a done job whose archive was already removed.
+	ExportExpired = "expired"
+)
+
+// ExportJob is a personal data export built in the background.
+type ExportJob struct {
+	ID        uuid.UUID `bson:"_id"`
+	UserID    uuid.UUID `bson:"user_id"`
+	Status    string    `bson:"status"`
+	ObjectKey string    `bson:"object_key,omitempty"`
+	Error     string    `bson:"error,omitempty"`
+	CreatedAt time.Time `bson:"created_at"`
+	UpdatedAt time.Time `bson:"updated_at"`
+}
@@ -2,59 +2,107 @@ package authclient
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/AlexMickh/speak-protos/pkg/api/auth"
-	"github.com/AlexMickh/speak-user/pkg/utils/retry"
+	"github.com/AlexMickh/speak-user/internal/config"
+	"github.com/sony/gobreaker"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 )
 
 type AuthClient struct {
-	conn *grpc.ClientConn
-	auth auth.AuthClient
+	conn    *grpc.ClientConn
+	auth    auth.AuthClient
+	timeout time.Duration
+	breaker *gobreaker.CircuitBreaker
 }
 
-func New(addr string) (*AuthClient, error) {
+func New(cfg config.AuthClientConfig) (*AuthClient, error) {
 	const op = "grpc.clients.auth.New"
 
-	var conn *grpc.ClientConn
-	var authClient auth.AuthClient
-
-	retry.WithDelay(5, 500*time.Millisecond, func() error {
-		connect, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
-		if err != nil {
-			return fmt.Errorf("%s: %w", op, err)
-		}
-
-		auth := auth.NewAuthClient(conn)
+	opts := []grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	}
+	if cfg.MaxAttempts > 1 {
+		opts = append(opts, grpc.WithDefaultServiceConfig(retryServiceConfig(cfg)))
+	}
 
-		conn = connect
-		authClient = auth
+	conn, err := grpc.NewClient(cfg.Addr, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
 
-		return nil
+	breaker := gobreaker.NewCircuitBreaker(gobreaker.Settings{
+		Name:    "auth",
+		Timeout: cfg.BreakerTimeout,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			return counts.ConsecutiveFailures >= cfg.BreakerFailures
+		},
+		IsSuccessful: func(err error) bool {
+			return err == nil || !isTransient(err)
+		},
 	})
 
 	return &AuthClient{
-		conn: conn,
-		auth: authClient,
+		conn:    conn,
+		auth:    auth.NewAuthClient(conn),
+		timeout: cfg.Timeout,
+		breaker: breaker,
 	}, nil
 }
 
 func (a *AuthClient) GetUserId(ctx context.Context, token string) (string, error) {
 	const op = "grpc.clients.auth.GetUserId"
 
-	res, err := a.auth.VerifyToken(ctx, &auth.VerifyTokenRequest{
-		AccessToken: token,
+	ctx, cancel := context.WithTimeout(ctx, a.timeout)
+	defer cancel()
+
+	res, err := a.breaker.Execute(func() (any, error) {
+		return a.auth.VerifyToken(ctx, &auth.VerifyTokenRequest{
+			AccessToken: token,
+		})
 	})
 	if err != nil {
+		if errors.Is(err, gobreaker.ErrOpenState) || errors.Is(err, gobreaker.ErrTooManyRequests) {
+			err = status.Error(codes.Unavailable, "auth service circuit breaker is open")
+		}
 		return "", fmt.Errorf("%s: %w", op, err)
 	}
 
-	return res.GetUserId(), nil
+	return res.(*auth.VerifyTokenResponse).GetUserId(), nil
 }
 
 func (a *AuthClient) Close() {
 	a.conn.Close()
 }
+
+// isTransient reports whether err means the auth service is unhealthy
+// rather than that the token was rejected.
+func isTransient(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+		return true
+	default:
+		return false
+	}
+}
+
+func retryServiceConfig(cfg config.AuthClientConfig) string {
+	return fmt.Sprintf(`{
+		"methodConfig": [{
+			"name": [{"service": "auth.Auth"}],
+			"retryPolicy": {
+				"maxAttempts": %d,
+				"initialBackoff": "0.1s",
+				"maxBackoff": "1s",
+				"backoffMultiplier": 2,
+				"retryableStatusCodes": ["UNAVAILABLE", "RESOURCE_EXHAUSTED", "ABORTED"]
+			}
+		}]
+	}`, cfg.MaxAttempts)
+}
@@ -0,0 +1,187 @@
+package authclient
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+type Verifier interface {
+	GetUserId(ctx context.Context, token string) (string, error)
+}
+
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+	Size   int
+}
+
+func (s CacheStats) HitRate() float64 {
+	total := s.Hits + s.Misses
+	if total == 0 {
+		return 0
+	}
+
+	return float64(s.Hits) / float64(total)
+}
+
+type cacheEntry struct {
+	key       [sha256.Size]byte
+	userID    string
+	expiresAt time.Time
+}
+
+// CachedClient remembers verified tokens so that repeated requests with the
+// same token skip the auth service. Entries live until the token expires or
+// ttl passes, whichever comes first, and the least recently used ones are
+// evicted once size is reached.
+type CachedClient struct {
+	next  Verifier
+	size  int
+	ttl   time.Duration
+	group singleflight.Group
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]*list.Element
+	order   *list.List
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+func NewCached(next Verifier, size int, ttl time.Duration) *CachedClient {
+	return &CachedClient{
+		next:    next,
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[[sha256.Size]byte]*list.Element, size),
+		order:   list.New(),
+	}
+}
+
+func (c *CachedClient) GetUserId(ctx context.Context, token string) (string, error) {
+	const op = "grpc.clients.auth.CachedClient.GetUserId"
+
+	key := sha256.Sum256([]byte(token))
+
+	if userID, ok := c.get(key); ok {
+		c.hits.Add(1)
+		return userID, nil
+	}
+	c.misses.Add(1)
+
+	// Concurrent lookups of one token share a single call, so it must not
+	// be cancelled together with whichever request happened to start it.
+	callCtx := context.WithoutCancel(ctx)
+
+	res, err, _ := c.group.Do(string(key[:]), func() (any, error) {
+		userID, err := c.next.GetUserId(callCtx, token)
+		if err != nil {
+			return "", err
+		}
+
+		c.set(key, userID, c.expiresAt(token))
+
+		return userID, nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	return res.(string), nil
+}
+
+func (c *CachedClient) Stats() CacheStats {
+	c.mu.Lock()
+	size := c.order.Len()
+	c.mu.Unlock()
+
+	return CacheStats{
+		Hits:   c.hits.Load(),
+		Misses: c.misses.Load(),
+		Size:   size,
+	}
+}
+
+func (c *CachedClient) get(key [sha256.Size]byte) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+
+	entry := el.Value.(*cacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return "", false
+	}
+
+	c.order.MoveToFront(el)
+
+	return entry.userID, true
+}
+
+func (c *CachedClient) set(key [sha256.Size]byte, userID string, expiresAt time.Time) {
+	if c.size <= 0 || !time.Now().Before(expiresAt) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		el.Value = &cacheEntry{key: key, userID: userID, expiresAt: expiresAt}
+		c.order.MoveToFront(el)
+		return
+	}
+
+	for c.order.Len() >= c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, userID: userID, expiresAt: expiresAt})
+}
+
+// expiresAt caps the cache ttl by the exp claim when the token is a JWT.
+// The token has already been verified by the auth service, so the payload
+// is only decoded here, not checked.
+func (c *CachedClient) expiresAt(token string) time.Time {
+	expiresAt := time.Now().Add(c.ttl)
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return expiresAt
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return expiresAt
+	}
+
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return expiresAt
+	}
+
+	if exp := time.Unix(claims.Exp, 0); exp.Before(expiresAt) {
+		return exp
+	}
+
+	return expiresAt
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"strings"
+
+	"github.com/AlexMickh/speak-protos/pkg/api/user"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type Policy int
+
+const (
+	// PolicyAuthenticated requires a valid Bearer token.
+	PolicyAuthenticated Policy = iota
+	// PolicyPublic lets any caller through.
+	PolicyPublic
+	// PolicySelf requires a valid Bearer token that belongs to the user
+	// the request is about.
+	PolicySelf
+	// PolicyInternal is reserved for other speak services presenting the
+	// shared internal token. Unless the token is enforced, callers that
+	// present no token at all are let through too.
+	PolicyInternal
+)
+
+const (
+	authorizationHeader = "authorization"
+	internalTokenHeader = "x-internal-token"
+)
+
+// Policies is the access policy of every User RPC. Methods missing from the
+// table require an authenticated caller.
+var Policies = map[string]Policy{
+	user.User_CreateUser_FullMethodName:     PolicyInternal,
+	user.User_GetUser_FullMethodName:        PolicyInternal,
+	user.User_VerifyEmail_FullMethodName:    PolicyPublic,
+	user.User_UpdateUserInfo_FullMethodName: PolicyAuthenticated,
+	user.User_DeleteUser_FullMethodName:     PolicySelf,
+}
+
+type AuthClient interface {
+	GetUserId(ctx context.Context, token string) (string, error)
+}
+
+type userIDKey struct{}
+
+// UserIDFromContext returns the id of the authenticated caller. It is empty
+// for public and internal calls.
+func UserIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(userIDKey{}).(string)
+	return id
+}
+
+type Auth struct {
+	authClient      AuthClient
+	internalToken   string
+	enforceInternal bool
+	policies        map[string]Policy
+}
+
+func NewAuth(authClient AuthClient, internalToken string, enforceInternal bool, policies map[string]Policy) *Auth {
+	return &Auth{
+		authClient:      authClient,
+		internalToken:   internalToken,
+		enforceInternal: enforceInternal,
+		policies:        policies,
+	}
+}
+
+func (a *Auth) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		policy := a.policies[info.FullMethod]
+
+		ctx, err := a.authenticate(ctx, policy)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := checkSelf(ctx, policy, req); err != nil {
+			return nil, err
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+func (a *Auth) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		policy := a.policies[info.FullMethod]
+
+		ctx, err := a.authenticate(ss.Context(), policy)
+		if err != nil {
+			return err
+		}
+
+		return handler(srv, &authStream{ServerStream: ss, ctx: ctx, policy: policy})
+	}
+}
+
+func (a *Auth) authenticate(ctx context.Context, policy Policy) (context.Context, error) {
+	if policy == PolicyPublic {
+		return ctx, nil
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	if policy == PolicyInternal {
+		if !a.isInternal(md) && (a.enforceInternal || len(md.Get(internalTokenHeader)) > 0) {
+			return nil, status.Error(codes.PermissionDenied, "method is available to internal services only")
+		}
+		return ctx, nil
+	}
+
+	token, err := bearerToken(md)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := a.authClient.GetUserId(ctx, token)
+	if err != nil {
+		switch status.Code(err) {
+		case codes.Unavailable, codes.DeadlineExceeded:
+			return nil, status.Error(codes.Unavailable, "auth service is unavailable")
+		default:
+			return nil, status.Error(codes.Unauthenticated, "invalid token")
+		}
+	}
+
+	return context.WithValue(ctx, userIDKey{}, id), nil
+}
+
+func (a *Auth) isInternal(md metadata.MD) bool {
+	if a.internalToken == "" {
+		return false
+	}
+
+	values := md.Get(internalTokenHeader)
+	if len(values) == 0 {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(values[0]), []byte(a.internalToken)) == 1
+}
+
+func bearerToken(md metadata.MD) (string, error) {
+	values := md.Get(authorizationHeader)
+	if len(values) == 0 {
+		return "", status.Error(codes.Unauthenticated, "authorization header is empty")
+	}
+
+	scheme, token, ok := strings.Cut(values[0], " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", status.Error(codes.Unauthenticated, "wrong token type, need Bearer")
+	}
+
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return "", status.Error(codes.Unauthenticated, "token is empty")
+	}
+
+	return token, nil
+}
+
+// checkSelf makes sure a PolicySelf request targets the caller.
+func checkSelf(ctx context.Context, policy Policy, req any) error {
+	if policy != PolicySelf {
+		return nil
+	}
+
+	r, ok := req.(interface{ GetId() string })
+	if !ok || r.GetId() != UserIDFromContext(ctx) {
+		return status.Error(codes.PermissionDenied, "access to another user is denied")
+	}
+
+	return nil
+}
+
+type authStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	policy Policy
+}
+
+func (s *authStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *authStream) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+
+	return checkSelf(s.ctx, s.policy, m)
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"errors"
+
+	errs "github.com/AlexMickh/speak-user/internal/domain/errors"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const errorDomain = "speak-user"
+
+type errorMapping struct {
+	err    error
+	code   codes.Code
+	reason string
+}
+
+var errorMappings = []errorMapping{
+	{err: errs.ErrUserNotFound, code: codes.NotFound, reason: "USER_NOT_FOUND"},
+	{err: errs.ErrVersionConflict, code: codes.Aborted, reason: "VERSION_CONFLICT"},
+	{err: errs.ErrEmailTaken, code: codes.AlreadyExists, reason: "EMAIL_TAKEN"},
+	{err: errs.ErrInvalidEmail, code: codes.InvalidArgument, reason: "INVALID_EMAIL"},
+	{err: errs.ErrUsernameTaken, code: codes.AlreadyExists, reason: "USERNAME_TAKEN"},
+	{err: errs.ErrInvalidUsername, code: codes.InvalidArgument, reason: "INVALID_USERNAME"},
+	{err: errs.ErrUsernameReserved, code: codes.InvalidArgument, reason: "USERNAME_RESERVED"},
+	{err: errs.ErrRenameCooldown, code: codes.FailedPrecondition, reason: "RENAME_COOLDOWN"},
+	{err: errs.ErrInvalidID, code: codes.InvalidArgument, reason: "INVALID_ID"},
+	{err: errs.ErrImageTooLarge, code: codes.InvalidArgument, reason: "IMAGE_TOO_LARGE"},
+	{err: errs.ErrInvalidImage, code: codes.InvalidArgument, reason: "INVALID_IMAGE"},
+	{err: errs.ErrChecksumMismatch, code: codes.InvalidArgument, reason: "CHECKSUM_MISMATCH"},
+	{err: errs.ErrUploadNotFound, code: codes.NotFound, reason: "UPLOAD_NOT_FOUND"},
+	{err: errs.ErrExportNotFound, code: codes.NotFound, reason: "EXPORT_NOT_FOUND"},
+	{err: errs.ErrExportDisabled, code: codes.Unimplemented, reason: "EXPORT_DISABLED"},
+	{err: errs.ErrTokensDisabled, code: codes.Unimplemented, reason: "VERIFICATION_DISABLED"},
+	{err: errs.ErrTokenNotFound, code: codes.NotFound, reason: "TOKEN_NOT_FOUND"},
+	{err: errs.ErrTokenExpired, code: codes.FailedPrecondition, reason: "TOKEN_EXPIRED"},
+	{err: errs.ErrTokenUsed, code: codes.FailedPrecondition, reason: "TOKEN_USED"},
+	{err: errs.ErrEmailVerified, code: codes.FailedPrecondition, reason: "EMAIL_VERIFIED"},
+	{err: errs.ErrTooManyRequests, code: codes.ResourceExhausted, reason: "TOO_MANY_REQUESTS"},
+	{err: errs.ErrInvalidResumeToken, code: codes.InvalidArgument, reason: "INVALID_RESUME_TOKEN"},
+	{err: errs.ErrBatchTooLarge, code: codes.InvalidArgument, reason: "BATCH_TOO_LARGE"},
+	{err: errs.ErrInvalidCursor, code: codes.InvalidArgument, reason: "INVALID_CURSOR"},
+	{err: errs.ErrInvalidFieldMask, code: codes.InvalidArgument, reason: "INVALID_FIELD_MASK"},
+	{err: errs.ErrInvalidCredentials, code: codes.Unauthenticated, reason: "INVALID_CREDENTIALS"},
+}
+
+// ErrorInterceptor converts domain errors returned by handlers into gRPC
+// statuses. Errors that already carry a status are passed through, anything
+// else becomes codes.Internal without exposing the underlying message.
+func ErrorInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		resp, err := handler(ctx, req)
+		if err != nil {
+			return resp, toStatus(err)
+		}
+
+		return resp, nil
+	}
+}
+
+func toStatus(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	for _, m := range errorMappings {
+		if !errors.Is(err, m.err) {
+			continue
+		}
+
+		st := status.New(m.code, m.err.Error())
+		detailed, detailsErr := st.WithDetails(&errdetails.ErrorInfo{
+			Reason: m.reason,
+			Domain: errorDomain,
+		})
+		if detailsErr != nil {
+			return st.Err()
+		}
+
+		return detailed.Err()
+	}
+
+	return status.Error(codes.Internal, "internal error")
+}
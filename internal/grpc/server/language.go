@@ -0,0 +1,26 @@
+package server
+
+import (
+	"context"
+
+	"github.com/AlexMickh/speak-user/internal/notifier"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// acceptLanguageHeader carries the languages of the caller, the gateway
+// forwards it from the HTTP request.
+const acceptLanguageHeader = "accept-language"
+
+// LanguageInterceptor passes the languages the caller accepts on to the
+// notifier, so emails sent while handling the call are written in them.
+func LanguageInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if values := md.Get(acceptLanguageHeader); len(values) > 0 {
+			ctx = notifier.WithLanguages(ctx, values[0])
+		}
+
+		return handler(ctx, req)
+	}
+}
@@ -2,18 +2,22 @@ package server
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
 	"net/mail"
+	"strconv"
 	"strings"
 
 	"github.com/AlexMickh/speak-protos/pkg/api/user"
 	"github.com/AlexMickh/speak-user/internal/domain/models"
 	"github.com/AlexMickh/speak-user/pkg/sl"
 	"github.com/google/uuid"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
 )
 
 type Service interface {
@@ -26,31 +30,40 @@ type Service interface {
 		image *models.Image,
 	) (string, error)
 	GetUser(ctx context.Context, email string) (models.User, error)
-	VerifyEmail(ctx context.Context, id string) error
+	VerifyEmail(ctx context.Context, token string) error
 	UpdateUser(
 		ctx context.Context,
 		id string,
+		mask []string,
 		username *string,
 		description *string,
 		image *models.Image,
+		expectedVersion *int64,
 	) (models.User, error)
 	DeleteUser(ctx context.Context, id string) error
 }
 
-type AuthClient interface {
-	GetUserId(ctx context.Context, token string) (string, error)
+const (
+	expectedVersionHeader = "x-expected-version"
+	versionHeader         = "x-user-version"
+	updateMaskHeader      = "x-update-mask"
+)
+
+// updatableFields is the allow-list of UpdateUserInfo field mask paths.
+var updatableFields = map[string]bool{
+	models.UserFieldUsername:     true,
+	models.UserFieldDescription:  true,
+	models.UserFieldProfileImage: true,
 }
 
 type Server struct {
 	user.UnimplementedUserServer
-	service    Service
-	authClient AuthClient
+	service Service
 }
 
-func New(service Service, authClient AuthClient) *Server {
+func New(service Service) *Server {
 	return &Server{
-		service:    service,
-		authClient: authClient,
+		service: service,
 	}
 }
 
@@ -99,7 +112,7 @@ func (s *Server) CreateUser(ctx context.Context, req *user.CreateUserRequest) (*
 	)
 	if err != nil {
 		sl.GetFromCtx(ctx).Error(ctx, "failed to save user", sl.Err(err))
-		return nil, status.Error(codes.Internal, "failed to save user")
+		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
 	return &user.CreateUserResponse{
@@ -126,7 +139,21 @@ func (s *Server) GetUser(ctx context.Context, req *user.GetUserRequest) (*user.G
 	userModel, err := s.service.GetUser(ctx, req.GetEmail())
 	if err != nil {
 		sl.GetFromCtx(ctx).Error(ctx, "failed to get user", sl.Err(err))
-		return nil, status.Error(codes.Internal, "failed to get user")
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	setVersionHeader(ctx, userModel.Version)
+
+	// Cleared fields are removed from the document and come back nil.
+	empty := ""
+	if userModel.Username == nil {
+		userModel.Username = &empty
+	}
+	if userModel.Description == nil {
+		userModel.Description = &empty
+	}
+	if userModel.ProfileImageUrl == nil {
+		userModel.ProfileImageUrl = &empty
 	}
 
 	return &user.GetUserResponse{
@@ -144,15 +171,16 @@ func (s *Server) VerifyEmail(ctx context.Context, req *user.VerifyEmailRequest)
 
 	ctx = sl.GetFromCtx(ctx).With(ctx, slog.String("op", op))
 
+	// The id field of VerifyEmailRequest carries the verification token.
 	if req.GetId() == "" {
-		sl.GetFromCtx(ctx).Error(ctx, "id is empty")
-		return nil, status.Error(codes.InvalidArgument, "id is required")
+		sl.GetFromCtx(ctx).Error(ctx, "token is empty")
+		return nil, status.Error(codes.InvalidArgument, "token is required")
 	}
 
 	err := s.service.VerifyEmail(ctx, req.GetId())
 	if err != nil {
 		sl.GetFromCtx(ctx).Error(ctx, "failed to verify email", sl.Err(err))
-		return nil, status.Error(codes.Internal, "failed to verify email")
+		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
 	return &emptypb.Empty{}, nil
@@ -166,30 +194,7 @@ func (s *Server) UpdateUserInfo(
 
 	ctx = sl.GetFromCtx(ctx).With(ctx, slog.String("op", op))
 
-	md, ok := metadata.FromIncomingContext(ctx)
-	if !ok {
-		sl.GetFromCtx(ctx).Error(ctx, "failed to get metadata")
-		return nil, status.Error(codes.InvalidArgument, "metadata is empty")
-	}
-
-	auth, ok := md["authorization"]
-	if !ok {
-		sl.GetFromCtx(ctx).Error(ctx, "failed to get auth header")
-		return nil, status.Error(codes.InvalidArgument, "authorization header is empty")
-	}
-
-	if strings.Split(auth[0], " ")[0] != "Bearer" {
-		sl.GetFromCtx(ctx).Error(ctx, "wrong token type")
-		return nil, status.Error(codes.InvalidArgument, "wrong token type, need Bearer")
-	}
-
-	token := strings.Split(auth[0], " ")[1]
-
-	id, err := s.authClient.GetUserId(ctx, token)
-	if err != nil {
-		sl.GetFromCtx(ctx).Error(ctx, "failed to get user id from token")
-		return nil, status.Error(codes.Internal, "failed to get user id")
-	}
+	id := UserIDFromContext(ctx)
 
 	var image *models.Image
 	if req.ProfileImage == nil {
@@ -200,24 +205,40 @@ func (s *Server) UpdateUserInfo(
 			Data: req.GetProfileImage(),
 		}
 	}
+
+	mask, err := updateMaskFromContext(ctx, req)
+	if err != nil {
+		sl.GetFromCtx(ctx).Error(ctx, "update mask is not valid", sl.Err(err))
+		return nil, status.Error(codes.InvalidArgument, "not valid update mask")
+	}
+
+	// Without a mask empty fields mean "keep", with one they mean "clear".
 	var username, description *string
-	if req.GetUsername() == "" {
+	if req.GetUsername() == "" && mask == nil {
 		username = nil
 	} else {
 		username = &req.Username
 	}
-	if req.GetDescription() == "" {
+	if req.GetDescription() == "" && mask == nil {
 		description = nil
 	} else {
 		description = &req.Description
 	}
 
-	userInfo, err := s.service.UpdateUser(ctx, id, username, description, image)
+	expectedVersion, err := expectedVersionFromContext(ctx)
+	if err != nil {
+		sl.GetFromCtx(ctx).Error(ctx, "expected version is not valid", sl.Err(err))
+		return nil, status.Error(codes.InvalidArgument, "not valid expected version")
+	}
+
+	userInfo, err := s.service.UpdateUser(ctx, id, mask, username, description, image, expectedVersion)
 	if err != nil {
 		sl.GetFromCtx(ctx).Error(ctx, "failed to update user", sl.Err(err))
-		return nil, status.Error(codes.Internal, "failed to update user")
+		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
+	setVersionHeader(ctx, userInfo.Version)
+
 	empty := ""
 	if userInfo.Username == nil {
 		userInfo.Username = &empty
@@ -238,6 +259,69 @@ func (s *Server) UpdateUserInfo(
 	}, nil
 }
 
+// updateMaskFromContext reads the optional field mask of an update, a comma
+// separated list of UpdateUserInfoRequest field names. Like the expected
+// version it travels in request metadata until the request gets a
+// FieldMask field.
+func updateMaskFromContext(ctx context.Context, req *user.UpdateUserInfoRequest) ([]string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	values := md.Get(updateMaskHeader)
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	var paths []string
+	for _, path := range strings.Split(values[0], ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+
+	mask, err := fieldmaskpb.New(req, paths...)
+	if err != nil {
+		return nil, err
+	}
+	mask.Normalize()
+
+	for _, path := range mask.GetPaths() {
+		if !updatableFields[path] {
+			return nil, fmt.Errorf("field %q can't be updated", path)
+		}
+	}
+
+	return append([]string{}, mask.GetPaths()...), nil
+}
+
+// setVersionHeader tells the caller the version of the user it got back,
+// which is what it sends in x-expected-version on its next update.
+func setVersionHeader(ctx context.Context, version int64) {
+	err := grpc.SetHeader(ctx, metadata.Pairs(versionHeader, strconv.FormatInt(version, 10)))
+	if err != nil {
+		sl.GetFromCtx(ctx).Error(ctx, "failed to send version header", sl.Err(err))
+	}
+}
+
+// expectedVersionFromContext reads the optional expected version of an
+// update. UpdateUserInfoRequest has no field for it yet, so it travels in
+// request metadata. GetUser and UpdateUserInfo send the current version
+// back in the response header.
+func expectedVersionFromContext(ctx context.Context) (*int64, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	values := md.Get(expectedVersionHeader)
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	version, err := strconv.ParseInt(values[0], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	return &version, nil
+}
+
 func (s *Server) DeleteUser(ctx context.Context, req *user.DeleteUserRequest) (*emptypb.Empty, error) {
 	const op = "grpc.server.DeleteUser"
 
@@ -251,7 +335,7 @@ func (s *Server) DeleteUser(ctx context.Context, req *user.DeleteUserRequest) (*
 	err := s.service.DeleteUser(ctx, req.GetId())
 	if err != nil {
 		sl.GetFromCtx(ctx).Error(ctx, "failed to delete user", sl.Err(err))
-		return nil, status.Error(codes.Internal, "falied to delete user")
+		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
 	return &emptypb.Empty{}, nil
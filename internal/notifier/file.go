@@ -0,0 +1,60 @@
+package notifier
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// File writes messages to w instead of delivering them. It is meant for
+// development and tests, messages contain live tokens.
+type File struct {
+	mu sync.Mutex
+	w  io.Writer
+	c  io.Closer
+}
+
+func NewStdout() *File {
+	return &File{w: os.Stdout}
+}
+
+func NewFile(path string) (*File, error) {
+	const op = "notifier.NewFile"
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return &File{w: f, c: f}, nil
+}
+
+func (f *File) Send(ctx context.Context, msg Message) error {
+	const op = "notifier.File.Send"
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, err := fmt.Fprintf(f.w, "Date: %s\nTo: %s\nSubject: %s\n\n%s\n---\n",
+		time.Now().Format(time.RFC1123Z),
+		msg.To,
+		msg.Subject,
+		msg.Text,
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+func (f *File) Close() error {
+	if f.c == nil {
+		return nil
+	}
+
+	return f.c.Close()
+}
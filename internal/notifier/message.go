@@ -0,0 +1,15 @@
+package notifier
+
+import "context"
+
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Sender delivers a rendered message.
+type Sender interface {
+	Send(ctx context.Context, msg Message) error
+}
@@ -0,0 +1,78 @@
+package notifier
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+)
+
+// Notifier renders account notifications and queues them for delivery.
+// Messages are written in the language the recipient asked for with
+// WithLanguages, or in the default locale of the templates.
+type Notifier struct {
+	templates *Templates
+	queue     *Queue
+	baseURL   string
+}
+
+func New(templates *Templates, queue *Queue, baseURL string) *Notifier {
+	return &Notifier{
+		templates: templates,
+		queue:     queue,
+		baseURL:   baseURL,
+	}
+}
+
+type languagesKey struct{}
+
+// WithLanguages returns ctx carrying the languages the recipient prefers,
+// in Accept-Language form.
+func WithLanguages(ctx context.Context, acceptLanguage string) context.Context {
+	return context.WithValue(ctx, languagesKey{}, acceptLanguage)
+}
+
+func languagesFromContext(ctx context.Context) string {
+	languages, _ := ctx.Value(languagesKey{}).(string)
+	return languages
+}
+
+func (n *Notifier) SendEmailVerification(ctx context.Context, email string, token string) error {
+	const op = "notifier.SendEmailVerification"
+
+	err := n.send(ctx, "email_verification", email, n.link("/verify-email", token))
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+func (n *Notifier) SendEmailChange(ctx context.Context, email string, token string) error {
+	const op = "notifier.SendEmailChange"
+
+	err := n.send(ctx, "email_change", email, n.link("/confirm-email", token))
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+func (n *Notifier) send(ctx context.Context, template string, to string, link string) error {
+	locale := n.templates.Match(languagesFromContext(ctx))
+
+	msg, err := n.templates.Render(template, locale, to, struct {
+		Link string
+	}{
+		Link: link,
+	})
+	if err != nil {
+		return err
+	}
+
+	return n.queue.Enqueue(msg)
+}
+
+func (n *Notifier) link(path string, token string) string {
+	return n.baseURL + path + "?token=" + url.QueryEscape(token)
+}
@@ -0,0 +1,121 @@
+package notifier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/AlexMickh/speak-user/pkg/sl"
+)
+
+var ErrQueueFull = errors.New("notification queue is full")
+
+// Queue hands messages to a Sender in the background, so callers never
+// wait for a mail server. Failed deliveries are retried a few times and
+// then dropped with an error in the log.
+type Queue struct {
+	sender      Sender
+	messages    chan Message
+	maxAttempts int
+	retryDelay  time.Duration
+	wg          sync.WaitGroup
+	cancel      context.CancelFunc
+}
+
+func NewQueue(sender Sender, size int, maxAttempts int, retryDelay time.Duration) *Queue {
+	return &Queue{
+		sender:      sender,
+		messages:    make(chan Message, size),
+		maxAttempts: maxAttempts,
+		retryDelay:  retryDelay,
+	}
+}
+
+// Start runs workers until Close. ctx only provides the logger, sends are
+// cancelled by Close.
+func (q *Queue) Start(ctx context.Context, workers int) {
+	ctx, q.cancel = context.WithCancel(context.WithoutCancel(ctx))
+
+	for range workers {
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+
+			for msg := range q.messages {
+				q.deliver(ctx, msg)
+			}
+		}()
+	}
+}
+
+func (q *Queue) Enqueue(msg Message) error {
+	const op = "notifier.Queue.Enqueue"
+
+	select {
+	case q.messages <- msg:
+		return nil
+	default:
+		return fmt.Errorf("%s: %w", op, ErrQueueFull)
+	}
+}
+
+// Close stops accepting messages and waits until the queued ones are sent.
+// Once ctx is done the sends in flight are cancelled and the messages still
+// queued are dropped.
+func (q *Queue) Close(ctx context.Context) error {
+	const op = "notifier.Queue.Close"
+
+	close(q.messages)
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+	if q.cancel != nil {
+		q.cancel()
+	}
+	<-done
+
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// deliver tries to send msg up to maxAttempts times. It gives up early
+// once ctx is done.
+func (q *Queue) deliver(ctx context.Context, msg Message) {
+	var err error
+	for attempt := range q.maxAttempts {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(q.retryDelay):
+			}
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+			break
+		}
+
+		if err = q.sender.Send(ctx, msg); err == nil {
+			return
+		}
+	}
+	if err != nil {
+		sl.GetFromCtx(ctx).Error(ctx, "failed to deliver notification",
+			slog.String("subject", msg.Subject),
+			sl.Err(err),
+		)
+	}
+}
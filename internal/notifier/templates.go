@@ -0,0 +1,138 @@
+package notifier
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"path"
+	"strings"
+	texttemplate "text/template"
+
+	"golang.org/x/text/language"
+)
+
+//go:embed templates
+var templatesFS embed.FS
+
+var ErrUnknownTemplate = errors.New("unknown template")
+
+// Templates renders messages from templates/<locale>/<name>.tmpl. Every
+// template defines "subject", "text" and "html" blocks. Locales missing a
+// template fall back to the default one.
+type Templates struct {
+	defaultLocale string
+	locales       []language.Tag
+	matcher       language.Matcher
+	text          map[string]*texttemplate.Template
+	html          map[string]*htmltemplate.Template
+}
+
+func NewTemplates(defaultLocale string) (*Templates, error) {
+	const op = "notifier.NewTemplates"
+
+	t := &Templates{
+		defaultLocale: defaultLocale,
+		text:          make(map[string]*texttemplate.Template),
+		html:          make(map[string]*htmltemplate.Template),
+	}
+
+	locales, err := templatesFS.ReadDir("templates")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	// The default locale goes first, a matcher falls back to it.
+	t.locales = append(t.locales, language.Make(defaultLocale))
+	for _, locale := range locales {
+		if locale.Name() != defaultLocale {
+			t.locales = append(t.locales, language.Make(locale.Name()))
+		}
+
+		files, err := fs.Glob(templatesFS, path.Join("templates", locale.Name(), "*.tmpl"))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+
+		for _, file := range files {
+			key := templateKey(locale.Name(), strings.TrimSuffix(path.Base(file), ".tmpl"))
+
+			t.text[key], err = texttemplate.ParseFS(templatesFS, file)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", op, err)
+			}
+			t.html[key], err = htmltemplate.ParseFS(templatesFS, file)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", op, err)
+			}
+		}
+	}
+
+	if _, ok := t.text[templateKey(defaultLocale, "email_verification")]; !ok {
+		return nil, fmt.Errorf("%s: no templates for default locale %q", op, defaultLocale)
+	}
+	t.matcher = language.NewMatcher(t.locales)
+
+	return t, nil
+}
+
+// Match picks the locale that suits an Accept-Language list best, such as
+// "ru-RU,ru;q=0.9,en;q=0.8". It returns the default locale when nothing
+// fits.
+func (t *Templates) Match(acceptLanguage string) string {
+	if acceptLanguage == "" {
+		return t.defaultLocale
+	}
+
+	tags, _, err := language.ParseAcceptLanguage(acceptLanguage)
+	if err != nil || len(tags) == 0 {
+		return t.defaultLocale
+	}
+
+	_, index, confidence := t.matcher.Match(tags...)
+	if confidence == language.No {
+		return t.defaultLocale
+	}
+
+	base, _ := t.locales[index].Base()
+	return base.String()
+}
+
+func (t *Templates) Render(name string, locale string, to string, data any) (Message, error) {
+	const op = "notifier.Templates.Render"
+
+	key := templateKey(locale, name)
+	if _, ok := t.text[key]; !ok {
+		key = templateKey(t.defaultLocale, name)
+	}
+
+	text, ok := t.text[key]
+	if !ok {
+		return Message{}, fmt.Errorf("%s: %w: %s", op, ErrUnknownTemplate, name)
+	}
+	html := t.html[key]
+
+	var subject, body, htmlBody bytes.Buffer
+	if err := text.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return Message{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if err := text.ExecuteTemplate(&body, "text", data); err != nil {
+		return Message{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if err := html.ExecuteTemplate(&htmlBody, "html", data); err != nil {
+		return Message{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return Message{
+		To:      to,
+		Subject: subject.String(),
+		Text:    body.String(),
+		HTML:    htmlBody.String(),
+	}, nil
+}
+
+func templateKey(locale string, name string) string {
+	return locale + "/" + name
+}
@@ -0,0 +1,74 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/AlexMickh/speak-user/internal/domain/models"
+	"github.com/google/uuid"
+)
+
+type Storage interface {
+	UnpublishedEvents(ctx context.Context, limit int) ([]models.Event, error)
+	MarkEventPublished(ctx context.Context, id uuid.UUID) error
+}
+
+//go:generate mockgen -destination mocks/broker_mock.go github.com/AlexMickh/speak-user/internal/outbox Broker
+type Broker interface {
+	Publish(ctx context.Context, event models.Event) error
+	Close() error
+}
+
+// Relay moves events from the outbox to the broker. An event is marked
+// published only after the broker accepted it, so delivery is at least
+// once: consumers must deduplicate by event id.
+type Relay struct {
+	storage        Storage
+	broker         Broker
+	batchSize      int
+	publishTimeout time.Duration
+}
+
+func NewRelay(storage Storage, broker Broker, batchSize int, publishTimeout time.Duration) *Relay {
+	return &Relay{
+		storage:        storage,
+		broker:         broker,
+		batchSize:      batchSize,
+		publishTimeout: publishTimeout,
+	}
+}
+
+// Relay publishes pending events in order and stops at the first failure,
+// so a later event never overtakes an earlier one.
+func (r *Relay) Relay(ctx context.Context) (int, error) {
+	const op = "outbox.Relay"
+
+	events, err := r.storage.UnpublishedEvents(ctx, r.batchSize)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	for i, event := range events {
+		err = r.publish(ctx, event)
+		if err != nil {
+			return i, fmt.Errorf("%s: %w", op, err)
+		}
+
+		err = r.storage.MarkEventPublished(ctx, event.ID)
+		if err != nil {
+			return i, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	return len(events), nil
+}
+
+// publish bounds a single publish, so a broker that never answers holds up
+// the relay for publishTimeout at most.
+func (r *Relay) publish(ctx context.Context, event models.Event) error {
+	ctx, cancel := context.WithTimeout(ctx, r.publishTimeout)
+	defer cancel()
+
+	return r.broker.Publish(ctx, event)
+}
@@ -0,0 +1,330 @@
+package service
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	errs "github.com/AlexMickh/speak-user/internal/domain/errors"
+	"github.com/AlexMickh/speak-user/internal/domain/models"
+	"github.com/AlexMickh/speak-user/pkg/sl"
+	"github.com/google/uuid"
+)
+
+type exportManifest struct {
+	UserID    uuid.UUID     `json:"user_id"`
+	CreatedAt time.Time     `json:"created_at"`
+	Files     []exportEntry `json:"files"`
+}
+
+type exportEntry struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+// ExportUserData gathers everything stored about the user into a ZIP
+// archive and returns a link to download it. Large accounts should use
+// RequestExport instead, which builds the archive in the background.
+// Exports fail with ErrExportDisabled until a signing secret is set.
+func (s *Service) ExportUserData(ctx context.Context, id string) (models.DataExport, error) {
+	const op = "service.ExportUserData"
+
+	if s.export.Secret == "" {
+		return models.DataExport{}, fmt.Errorf("%s: %w", op, errs.ErrExportDisabled)
+	}
+
+	userID, err := uuid.Parse(id)
+	if err != nil {
+		return models.DataExport{}, fmt.Errorf("%s: %w: %w", op, errs.ErrInvalidID, err)
+	}
+
+	key, err := s.buildExport(ctx, userID, uuid.New())
+	if err != nil {
+		return models.DataExport{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	url, expiresAt, err := s.s3.ExportUrl(ctx, key)
+	if err != nil {
+		return models.DataExport{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return models.DataExport{
+		Url:       url,
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+// RequestExport queues an export of the user's data and returns the job
+// id to poll GetExport with.
+func (s *Service) RequestExport(ctx context.Context, id string) (string, error) {
+	const op = "service.RequestExport"
+
+	if s.export.Secret == "" {
+		return "", fmt.Errorf("%s: %w", op, errs.ErrExportDisabled)
+	}
+
+	userID, err := uuid.Parse(id)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w: %w", op, errs.ErrInvalidID, err)
+	}
+
+	if _, err := s.db.GetUserByID(ctx, userID); err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	now := time.Now()
+	job := models.ExportJob{
+		ID:        uuid.New(),
+		UserID:    userID,
+		Status:    models.ExportPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	err = s.db.CreateExportJob(ctx, job)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	return job.ID.String(), nil
+}
+
+// GetExport returns an export job of the user. Once the job is done the
+// returned DataExport holds a fresh download link. Jobs whose archive was
+// already removed from the bucket come back as ExportExpired.
+func (s *Service) GetExport(ctx context.Context, id string, jobID string) (models.ExportJob, models.DataExport, error) {
+	const op = "service.GetExport"
+
+	userID, err := uuid.Parse(id)
+	if err != nil {
+		return models.ExportJob{}, models.DataExport{}, fmt.Errorf("%s: %w: %w", op, errs.ErrInvalidID, err)
+	}
+	exportID, err := uuid.Parse(jobID)
+	if err != nil {
+		return models.ExportJob{}, models.DataExport{}, fmt.Errorf("%s: %w: %w", op, errs.ErrInvalidID, err)
+	}
+
+	job, err := s.db.GetExportJob(ctx, exportID, userID)
+	if err != nil {
+		return models.ExportJob{}, models.DataExport{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if job.Status != models.ExportDone {
+		return job, models.DataExport{}, nil
+	}
+
+	url, expiresAt, err := s.s3.ExportUrl(ctx, job.ObjectKey)
+	if err != nil {
+		if errors.Is(err, errs.ErrExportNotFound) {
+			job.Status = models.ExportExpired
+			return job, models.DataExport{}, nil
+		}
+		return models.ExportJob{}, models.DataExport{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return job, models.DataExport{Url: url, ExpiresAt: expiresAt}, nil
+}
+
+// RunExportJobs builds queued exports until none are left and returns how
+// many it finished. A failed export is recorded on its job and does not
+// stop the others.
+func (s *Service) RunExportJobs(ctx context.Context) (int, error) {
+	const op = "service.RunExportJobs"
+
+	if s.export.Secret == "" {
+		return 0, nil
+	}
+
+	done := 0
+	for {
+		job, err := s.db.ClaimExportJob(ctx)
+		if err != nil {
+			if errors.Is(err, errs.ErrExportNotFound) {
+				return done, nil
+			}
+			return done, fmt.Errorf("%s: %w", op, err)
+		}
+
+		key, err := s.buildExport(ctx, job.UserID, job.ID)
+		errMsg := ""
+		if err != nil {
+			sl.GetFromCtx(ctx).Error(ctx, "failed to build export", sl.Err(err))
+			errMsg = "failed to build export"
+		}
+
+		err = s.db.FinishExportJob(ctx, job.ID, key, errMsg)
+		if err != nil {
+			return done, fmt.Errorf("%s: %w", op, err)
+		}
+
+		done++
+	}
+}
+
+// buildExport writes the archive to a temporary file first, since avatars
+// can make it too big to hold in memory, and returns its object key. The
+// archive holds the user document without the password hash, the user's
+// events and every object the user owns, plus a manifest with checksums
+// signed with the export secret.
+//
+// The events come from the outbox, which drops published events after a
+// week, so they are the user's recent activity rather than a full history.
+func (s *Service) buildExport(ctx context.Context, userID uuid.UUID, exportID uuid.UUID) (string, error) {
+	const op = "service.buildExport"
+
+	user, err := s.db.GetUserByID(ctx, userID)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+	user.Password = ""
+
+	events, err := s.db.UserEvents(ctx, userID)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	uploads, err := s.s3.ListImagesWithPrefix(ctx, uploadPrefix(userID))
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	file, err := os.CreateTemp("", "export-*.zip")
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	zw := zip.NewWriter(file)
+	manifest := exportManifest{
+		UserID:    userID,
+		CreatedAt: time.Now(),
+	}
+
+	documents := []struct {
+		name string
+		data any
+	}{
+		{name: "user.json", data: user},
+		{name: "events.json", data: events},
+	}
+	for _, doc := range documents {
+		content, err := json.MarshalIndent(doc.data, "", "  ")
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", op, err)
+		}
+
+		entry, err := addExportFile(zw, doc.name, bytes.NewReader(content))
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", op, err)
+		}
+		manifest.Files = append(manifest.Files, entry)
+	}
+
+	// Avatars confirmed before uploads were processed kept their upload
+	// key, which is then among both the avatars and the uploads.
+	keys := make([]string, 0, len(user.ProfileImages)+len(uploads))
+	seen := make(map[string]struct{}, cap(keys))
+	add := func(key string) {
+		if _, ok := seen[key]; ok {
+			return
+		}
+		seen[key] = struct{}{}
+		keys = append(keys, key)
+	}
+	for _, key := range user.ProfileImages {
+		add(key)
+	}
+	for _, upload := range uploads {
+		add(upload.Key)
+	}
+
+	for _, key := range keys {
+		entry, err := s.addExportObject(ctx, zw, key)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", op, err)
+		}
+		manifest.Files = append(manifest.Files, entry)
+	}
+
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+	if _, err := addExportFile(zw, "manifest.json", bytes.NewReader(content)); err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	mac := hmac.New(sha256.New, []byte(s.export.Secret))
+	mac.Write(content)
+	signature := hex.EncodeToString(mac.Sum(nil))
+	if _, err := addExportFile(zw, "manifest.json.sig", bytes.NewReader([]byte(signature))); err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := zw.Close(); err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	size, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	key := fmt.Sprintf("%s/%s.zip", userID, exportID)
+
+	err = s.s3.SaveExport(ctx, key, file, size)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	return key, nil
+}
+
+func (s *Service) addExportObject(ctx context.Context, zw *zip.Writer, key string) (exportEntry, error) {
+	const op = "service.addExportObject"
+
+	object, err := s.s3.OpenImage(ctx, key)
+	if err != nil {
+		return exportEntry{}, fmt.Errorf("%s: %w", op, err)
+	}
+	defer object.Close()
+
+	entry, err := addExportFile(zw, "objects/"+key, object)
+	if err != nil {
+		return exportEntry{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return entry, nil
+}
+
+func addExportFile(zw *zip.Writer, name string, r io.Reader) (exportEntry, error) {
+	w, err := zw.Create(name)
+	if err != nil {
+		return exportEntry{}, err
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(w, hash), r)
+	if err != nil {
+		return exportEntry{}, err
+	}
+
+	return exportEntry{
+		Name:   name,
+		Size:   size,
+		Sha256: hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
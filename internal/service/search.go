@@ -0,0 +1,88 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	errs "github.com/AlexMickh/speak-user/internal/domain/errors"
+	"github.com/AlexMickh/speak-user/internal/domain/models"
+)
+
+// SearchUsers finds verified users whose username starts with query,
+// ignoring case. A limit of zero means the configured default, larger
+// limits are capped. The returned cursor is empty on the last page,
+// otherwise passing it back yields the next one.
+func (s *Service) SearchUsers(
+	ctx context.Context,
+	query string,
+	limit int,
+	cursor string,
+) ([]models.PublicProfile, string, error) {
+	const op = "service.SearchUsers"
+
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil, "", nil
+	}
+
+	if limit <= 0 {
+		limit = s.users.SearchDefaultLimit
+	}
+	limit = min(limit, s.users.SearchMaxLimit)
+
+	var after *models.SearchCursor
+	if cursor != "" {
+		decoded, err := decodeCursor(cursor)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s: %w", op, err)
+		}
+		after = &decoded
+	}
+
+	// One extra user tells whether there is a next page.
+	profiles, err := s.db.SearchUsers(ctx, query, after, limit+1)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	next := ""
+	if len(profiles) > limit {
+		profiles = profiles[:limit]
+
+		last := profiles[limit-1]
+		next = encodeCursor(models.SearchCursor{
+			Username: *last.Username,
+			ID:       last.ID,
+		})
+	}
+
+	for i := range profiles {
+		if err := s.presignAvatars(ctx, &profiles[i]); err != nil {
+			return nil, "", fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	return profiles, next, nil
+}
+
+func encodeCursor(cursor models.SearchCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(cursor string) (models.SearchCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return models.SearchCursor{}, errs.ErrInvalidCursor
+	}
+
+	var decoded models.SearchCursor
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return models.SearchCursor{}, errs.ErrInvalidCursor
+	}
+
+	return decoded, nil
+}
@@ -1,11 +1,26 @@
 package service
 
 import (
+	"bufio"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/AlexMickh/speak-user/internal/config"
+	errs "github.com/AlexMickh/speak-user/internal/domain/errors"
 	"github.com/AlexMickh/speak-user/internal/domain/models"
+	"github.com/AlexMickh/speak-user/pkg/hasher"
+	"github.com/AlexMickh/speak-user/pkg/imageproc"
+	"github.com/AlexMickh/speak-user/pkg/sl"
+	usernamepkg "github.com/AlexMickh/speak-user/pkg/username"
 	"github.com/google/uuid"
 )
 
@@ -13,33 +28,112 @@ import (
 type DB interface {
 	SaveUser(ctx context.Context, user models.User) error
 	GetUser(ctx context.Context, email string) (models.User, error)
+	GetUserByID(ctx context.Context, id uuid.UUID) (models.User, error)
+	GetUsers(ctx context.Context, ids []uuid.UUID) ([]models.User, error)
+	GetPublicProfile(ctx context.Context, id uuid.UUID) (models.PublicProfile, error)
+	UsernameTaken(ctx context.Context, key string) (bool, error)
+	SearchUsers(
+		ctx context.Context,
+		prefix string,
+		after *models.SearchCursor,
+		limit int,
+	) ([]models.PublicProfile, error)
 	ChangeEmailVerified(ctx context.Context, id uuid.UUID) error
-	UpdateUser(
+	UpdateUser(ctx context.Context, id uuid.UUID, data models.UserUpdate) (models.User, error)
+	DeleteUser(ctx context.Context, id uuid.UUID) error
+	RestoreUser(ctx context.Context, id uuid.UUID, deletedAfter int64) error
+	DeletedUsers(ctx context.Context, deletedBefore int64, limit int) ([]uuid.UUID, error)
+	PurgeUser(ctx context.Context, id uuid.UUID, deletedBefore int64) (map[string]string, error)
+	UserEvents(ctx context.Context, userID uuid.UUID) ([]models.Event, error)
+	CreateExportJob(ctx context.Context, job models.ExportJob) error
+	GetExportJob(ctx context.Context, id uuid.UUID, userID uuid.UUID) (models.ExportJob, error)
+	ClaimExportJob(ctx context.Context) (models.ExportJob, error)
+	FinishExportJob(ctx context.Context, id uuid.UUID, objectKey string, errMsg string) error
+	GetProfileImages(ctx context.Context, id uuid.UUID) (map[string]string, error)
+	ReferencedImageKeys(ctx context.Context) (map[string]struct{}, error)
+	UsersWithOriginalAvatars(ctx context.Context, limit int) ([]models.User, error)
+	SkipOriginalAvatar(ctx context.Context, id uuid.UUID, key string) error
+	UpdatePassword(ctx context.Context, id uuid.UUID, password string) error
+	SaveVerificationToken(ctx context.Context, token models.VerificationToken) error
+	LastVerificationToken(ctx context.Context, userID uuid.UUID, purpose string) (models.VerificationToken, error)
+	UseVerificationToken(ctx context.Context, hash string, purpose string) (models.VerificationToken, error)
+	SetPendingEmail(ctx context.Context, id uuid.UUID, email string) error
+	ChangeEmail(ctx context.Context, id uuid.UUID, email string) error
+	WatchUsers(
 		ctx context.Context,
-		id uuid.UUID,
-		username *string,
-		description *string,
-		profileImageUrl *string,
-	) (models.User, error)
-	DeleteUser(ctx context.Context, id uuid.UUID) (string, error)
+		ids []uuid.UUID,
+		resumeToken string,
+		fn func(change models.UserChange) error,
+	) error
 }
 
 //go:generate mockgen -destination mocks/s3_mock.go github.com/AlexMickh/speak-user/internal/service S3
 type S3 interface {
-	SaveImage(ctx context.Context, image *models.Image) (string, error)
+	SaveImage(ctx context.Context, key string, data []byte, contentType string) error
+	SaveImageStream(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
 	GetImageUrl(ctx context.Context, imageId string) (string, error)
+	DefaultImageUrl(ctx context.Context) (string, error)
 	DeleteImage(ctx context.Context, imageId string) error
+	ListImages(ctx context.Context) ([]models.StoredImage, error)
+	ListImagesWithPrefix(ctx context.Context, prefix string) ([]models.StoredImage, error)
+	OpenImage(ctx context.Context, key string) (io.ReadCloser, error)
+	PresignUpload(ctx context.Context, key string, contentType string, maxSize int64) (models.PresignedUpload, error)
+	StatImage(ctx context.Context, key string) (models.StoredImage, error)
+	ReadImageHeader(ctx context.Context, key string, n int64) ([]byte, error)
+	SaveExport(ctx context.Context, key string, r io.Reader, size int64) error
+	ExportUrl(ctx context.Context, key string) (string, time.Time, error)
+}
+
+//go:generate mockgen -destination mocks/image_processor_mock.go github.com/AlexMickh/speak-user/internal/service ImageProcessor
+type ImageProcessor interface {
+	Process(data []byte) ([]imageproc.Variant, error)
+	ValidateStream(contentType string, size int64, header []byte) error
+	MaxBytes() int64
 }
 
+//go:generate mockgen -destination mocks/hasher_mock.go github.com/AlexMickh/speak-user/internal/service Hasher
+type Hasher interface {
+	Hash(password string) (string, error)
+	Verify(password string, hash string) (needsRehash bool, err error)
+}
+
+// sniffLen is how many leading bytes of a stream are enough to detect
+// its content type.
+const sniffLen = 512
+
 type Service struct {
-	db DB
-	s3 S3
+	db             DB
+	s3             S3
+	hasher         Hasher
+	imageProcessor ImageProcessor
+	signer         TokenSigner
+	notifier       Notifier
+	verification   config.VerificationConfig
+	users          config.UsersConfig
+	export         config.ExportConfig
 }
 
-func New(db DB, s3 S3) *Service {
+func New(
+	db DB,
+	s3 S3,
+	hasher Hasher,
+	imageProcessor ImageProcessor,
+	signer TokenSigner,
+	notifier Notifier,
+	verification config.VerificationConfig,
+	users config.UsersConfig,
+	export config.ExportConfig,
+) *Service {
 	return &Service{
-		db: db,
-		s3: s3,
+		db:             db,
+		s3:             s3,
+		hasher:         hasher,
+		imageProcessor: imageProcessor,
+		signer:         signer,
+		notifier:       notifier,
+		verification:   verification,
+		users:          users,
+		export:         export,
 	}
 }
 
@@ -55,21 +149,33 @@ func (s *Service) SaveUser(
 
 	id := uuid.New()
 
-	profileImageUrl, err := s.s3.SaveImage(ctx, image)
+	username, usernameKey, err := usernamepkg.Normalize(username)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, usernameError(err))
+	}
+
+	hash, err := s.hasher.Hash(password)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	profileImages, err := s.saveImage(ctx, image)
 	if err != nil {
 		return "", fmt.Errorf("%s: %w", op, err)
 	}
 
 	user := models.User{
-		ID:              id,
-		Email:           email,
-		Username:        &username,
-		Password:        password,
-		Description:     &description,
-		ProfileImageUrl: &profileImageUrl,
-		IsEmailVerified: false,
-		CreatedAt:       time.Now().Unix(),
-		UpdatedAt:       time.Now().Unix(),
+		ID:                 id,
+		Email:              email,
+		Username:           &username,
+		UsernameNormalized: usernameKey,
+		Password:           hash,
+		Description:        &description,
+		ProfileImages:      profileImages,
+		IsEmailVerified:    false,
+		CreatedAt:          time.Now().Unix(),
+		UpdatedAt:          time.Now().Unix(),
+		Version:            1,
 	}
 
 	err = s.db.SaveUser(ctx, user)
@@ -77,6 +183,8 @@ func (s *Service) SaveUser(
 		return "", fmt.Errorf("%s: %w", op, err)
 	}
 
+	s.sendInitialVerification(ctx, id, email)
+
 	return id.String(), nil
 }
 
@@ -88,18 +196,176 @@ func (s *Service) GetUser(ctx context.Context, email string) (models.User, error
 		return models.User{}, fmt.Errorf("%s: %w", op, err)
 	}
 
+	err = s.presignImage(ctx, &user)
+	if err != nil {
+		return models.User{}, fmt.Errorf("%s: %w", op, err)
+	}
+
 	return user, nil
 }
 
-func (s *Service) VerifyEmail(ctx context.Context, id string) error {
-	const op = "service.VerifyEmail"
+func (s *Service) GetUserByID(ctx context.Context, id string) (models.User, error) {
+	const op = "service.GetUserByID"
 
-	uuid, err := uuid.Parse(id)
+	userID, err := uuid.Parse(id)
+	if err != nil {
+		return models.User{}, fmt.Errorf("%s: %w: %w", op, errs.ErrInvalidID, err)
+	}
+
+	user, err := s.db.GetUserByID(ctx, userID)
+	if err != nil {
+		return models.User{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	err = s.presignImage(ctx, &user)
+	if err != nil {
+		return models.User{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return user, nil
+}
+
+// GetPublicProfile returns what other users may see about the user with
+// the given id. Without an avatar AvatarUrls holds the default image under
+// the "default" key.
+func (s *Service) GetPublicProfile(ctx context.Context, id string) (models.PublicProfile, error) {
+	const op = "service.GetPublicProfile"
+
+	userID, err := uuid.Parse(id)
+	if err != nil {
+		return models.PublicProfile{}, fmt.Errorf("%s: %w: %w", op, errs.ErrInvalidID, err)
+	}
+
+	profile, err := s.db.GetPublicProfile(ctx, userID)
+	if err != nil {
+		return models.PublicProfile{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	err = s.presignAvatars(ctx, &profile)
+	if err != nil {
+		return models.PublicProfile{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return profile, nil
+}
+
+func (s *Service) presignAvatars(ctx context.Context, profile *models.PublicProfile) error {
+	const op = "service.presignAvatars"
+
+	profile.AvatarUrls = make(map[string]string, max(len(profile.ProfileImages), 1))
+	if len(profile.ProfileImages) == 0 {
+		url, err := s.s3.DefaultImageUrl(ctx)
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		profile.AvatarUrls["default"] = url
+	}
+	for size, key := range profile.ProfileImages {
+		url, err := s.s3.GetImageUrl(ctx, key)
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		profile.AvatarUrls[size] = url
+	}
+
+	return nil
+}
+
+// BatchGetUsers looks up many users with one query. Users come back in the
+// order of ids, duplicates are looked up once, and ids nobody has are
+// returned as missing instead of failing the whole batch.
+func (s *Service) BatchGetUsers(ctx context.Context, ids []string) ([]models.User, []string, error) {
+	const op = "service.BatchGetUsers"
+
+	userIDs := make([]uuid.UUID, 0, len(ids))
+	seen := make(map[uuid.UUID]struct{}, len(ids))
+	for _, id := range ids {
+		userID, err := uuid.Parse(id)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w: %w", op, errs.ErrInvalidID, err)
+		}
+		if _, ok := seen[userID]; ok {
+			continue
+		}
+		seen[userID] = struct{}{}
+		userIDs = append(userIDs, userID)
+	}
+
+	if len(userIDs) > s.users.BatchMaxSize {
+		return nil, nil, fmt.Errorf("%s: %w", op, errs.ErrBatchTooLarge)
+	}
+	if len(userIDs) == 0 {
+		return nil, nil, nil
+	}
+
+	found, err := s.db.GetUsers(ctx, userIDs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	byID := make(map[uuid.UUID]models.User, len(found))
+	for _, user := range found {
+		byID[user.ID] = user
+	}
+
+	users := make([]models.User, 0, len(found))
+	var missing []string
+	for _, userID := range userIDs {
+		user, ok := byID[userID]
+		if !ok {
+			missing = append(missing, userID.String())
+			continue
+		}
+
+		if err := s.presignImage(ctx, &user); err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", op, err)
+		}
+		users = append(users, user)
+	}
+
+	return users, missing, nil
+}
+
+// VerifyPassword checks the password of the user with the given email and
+// returns the user's id. Hashes made with outdated parameters or with
+// bcrypt, and passwords still stored in plaintext, are upgraded on success.
+func (s *Service) VerifyPassword(ctx context.Context, email string, password string) (string, error) {
+	const op = "service.VerifyPassword"
+
+	user, err := s.db.GetUser(ctx, email)
+	if err != nil {
+		if errors.Is(err, errs.ErrUserNotFound) {
+			return "", fmt.Errorf("%s: %w", op, errs.ErrInvalidCredentials)
+		}
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	needsRehash, err := s.hasher.Verify(password, user.Password)
+	if err != nil {
+		if errors.Is(err, hasher.ErrMismatch) {
+			return "", fmt.Errorf("%s: %w", op, errs.ErrInvalidCredentials)
+		}
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	if needsRehash {
+		if err := s.rehash(ctx, user.ID, password); err != nil {
+			sl.GetFromCtx(ctx).Error(ctx, "failed to rehash password", sl.Err(err))
+		}
+	}
+
+	return user.ID.String(), nil
+}
+
+func (s *Service) rehash(ctx context.Context, id uuid.UUID, password string) error {
+	const op = "service.rehash"
+
+	hash, err := s.hasher.Hash(password)
 	if err != nil {
 		return fmt.Errorf("%s: %w", op, err)
 	}
 
-	err = s.db.ChangeEmailVerified(ctx, uuid)
+	err = s.db.UpdatePassword(ctx, id, hash)
 	if err != nil {
 		return fmt.Errorf("%s: %w", op, err)
 	}
@@ -107,35 +373,93 @@ func (s *Service) VerifyEmail(ctx context.Context, id string) error {
 	return nil
 }
 
+// UpdateUser changes the fields of the user named in mask. A named field
+// with an empty value is cleared, which for the profile image means going
+// back to the default avatar. Without a mask every non-empty value is set
+// and nothing is cleared. With expectedVersion set the update fails with
+// ErrVersionConflict if somebody changed the user since the caller read
+// that version.
 func (s *Service) UpdateUser(
 	ctx context.Context,
 	id string,
+	mask []string,
 	username *string,
 	description *string,
 	image *models.Image,
+	expectedVersion *int64,
 ) (models.User, error) {
 	const op = "serive.UpdateUser"
 
 	uuid, err := uuid.Parse(id)
 	if err != nil {
-		return models.User{}, fmt.Errorf("%s: %w", op, err)
+		return models.User{}, fmt.Errorf("%s: %w: %w", op, errs.ErrInvalidID, err)
 	}
 
-	if image != nil {
-		url, err := s.s3.SaveImage(ctx, image)
-		if err != nil {
-			return models.User{}, fmt.Errorf("%s: %w", op, err)
+	if len(mask) == 0 {
+		mask = implicitMask(username, description, image)
+	}
+
+	data := models.UserUpdate{
+		ExpectedVersion: expectedVersion,
+	}
+
+	var replaceImage bool
+	for _, field := range mask {
+		switch field {
+		case models.UserFieldUsername:
+			if username == nil || *username == "" {
+				data.Unset = append(data.Unset, "username", "username_normalized")
+				continue
+			}
+
+			data, err = s.rename(ctx, uuid, *username, data)
+			if err != nil {
+				return models.User{}, fmt.Errorf("%s: %w", op, err)
+			}
+		case models.UserFieldDescription:
+			if description == nil || *description == "" {
+				data.Unset = append(data.Unset, "description")
+				continue
+			}
+
+			data.Description = description
+		case models.UserFieldProfileImage:
+			replaceImage = true
+			if image == nil || len(image.Data) == 0 {
+				image = nil
+				data.Unset = append(data.Unset, "profile_images")
+			}
+		default:
+			return models.User{}, fmt.Errorf("%s: %w: unknown field %q", op, errs.ErrInvalidFieldMask, field)
 		}
+	}
 
-		user, err := s.db.UpdateUser(ctx, uuid, username, description, &url)
+	var oldImages map[string]string
+	if replaceImage {
+		oldImages, err = s.db.GetProfileImages(ctx, uuid)
 		if err != nil {
 			return models.User{}, fmt.Errorf("%s: %w", op, err)
 		}
+	} else {
+		image = nil
+	}
+
+	profileImages, err := s.saveImage(ctx, image)
+	if err != nil {
+		return models.User{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	data.ProfileImages = profileImages
 
-		return user, nil
+	user, err := s.db.UpdateUser(ctx, uuid, data)
+	if err != nil {
+		s.deleteImages(ctx, profileImages)
+		return models.User{}, fmt.Errorf("%s: %w", op, err)
 	}
 
-	user, err := s.db.UpdateUser(ctx, uuid, username, description, nil)
+	s.deleteImages(ctx, oldImages)
+
+	err = s.presignImage(ctx, &user)
 	if err != nil {
 		return models.User{}, fmt.Errorf("%s: %w", op, err)
 	}
@@ -143,23 +467,544 @@ func (s *Service) UpdateUser(
 	return user, nil
 }
 
+// implicitMask names every field that has a value, for callers that send
+// no mask.
+func implicitMask(username *string, description *string, image *models.Image) []string {
+	var mask []string
+	if username != nil && *username != "" {
+		mask = append(mask, models.UserFieldUsername)
+	}
+	if description != nil && *description != "" {
+		mask = append(mask, models.UserFieldDescription)
+	}
+	if image != nil {
+		mask = append(mask, models.UserFieldProfileImage)
+	}
+
+	return mask
+}
+
+// rename adds a username change to data. Changes that only touch case or
+// width keep the same key and are always allowed, others are limited to
+// one per cooldown. Resending the current username changes nothing, even
+// a legacy one that wouldn't pass validation today.
+func (s *Service) rename(
+	ctx context.Context,
+	id uuid.UUID,
+	username string,
+	data models.UserUpdate,
+) (models.UserUpdate, error) {
+	const op = "service.rename"
+
+	user, err := s.db.GetUserByID(ctx, id)
+	if err != nil {
+		return data, fmt.Errorf("%s: %w", op, err)
+	}
+	if user.Username != nil && *user.Username == username {
+		return data, nil
+	}
+
+	username, key, err := usernamepkg.Normalize(username)
+	if err != nil {
+		return data, fmt.Errorf("%s: %w", op, usernameError(err))
+	}
+
+	data.Username = &username
+
+	if user.UsernameNormalized == key {
+		return data, nil
+	}
+
+	now := time.Now()
+	if user.UsernameChangedAt != 0 && now.Before(time.Unix(user.UsernameChangedAt, 0).Add(s.users.RenameCooldown)) {
+		return data, fmt.Errorf("%s: %w", op, errs.ErrRenameCooldown)
+	}
+
+	changedAt := now.Unix()
+	data.UsernameNormalized = &key
+	data.UsernameChangedAt = &changedAt
+
+	return data, nil
+}
+
+// CheckUsernameAvailable tells whether username may be taken right now.
+// Reserved names are reported as unavailable, malformed ones as an error.
+func (s *Service) CheckUsernameAvailable(ctx context.Context, username string) (bool, error) {
+	const op = "service.CheckUsernameAvailable"
+
+	_, key, err := usernamepkg.Normalize(username)
+	if err != nil {
+		if errors.Is(err, usernamepkg.ErrReserved) {
+			return false, nil
+		}
+		return false, fmt.Errorf("%s: %w", op, usernameError(err))
+	}
+
+	taken, err := s.db.UsernameTaken(ctx, key)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return !taken, nil
+}
+
+// UploadAvatar streams an avatar from r straight into storage. Once the
+// checksum matches, the stored upload is processed into the usual avatar
+// variants, which are attached to the user, and the upload is removed.
+func (s *Service) UploadAvatar(
+	ctx context.Context,
+	id string,
+	upload models.AvatarUpload,
+	r io.Reader,
+) (models.User, error) {
+	const op = "service.UploadAvatar"
+
+	userID, err := uuid.Parse(id)
+	if err != nil {
+		return models.User{}, fmt.Errorf("%s: %w: %w", op, errs.ErrInvalidID, err)
+	}
+
+	br := bufio.NewReaderSize(r, sniffLen)
+	header, err := br.Peek(sniffLen)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return models.User{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	err = s.imageProcessor.ValidateStream(upload.ContentType, upload.Size, header)
+	if err != nil {
+		return models.User{}, fmt.Errorf("%s: %w", op, imageError(err))
+	}
+
+	oldImages, err := s.db.GetProfileImages(ctx, userID)
+	if err != nil {
+		return models.User{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	key := fmt.Sprintf("%s/original", uuid.New())
+	stored := map[string]string{"original": key}
+
+	hash := sha256.New()
+	err = s.s3.SaveImageStream(ctx, key, io.TeeReader(br, hash), upload.Size, upload.ContentType)
+	if err != nil {
+		return models.User{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if hex.EncodeToString(hash.Sum(nil)) != strings.ToLower(upload.Checksum) {
+		s.deleteImages(ctx, stored)
+		return models.User{}, fmt.Errorf("%s: %w", op, errs.ErrChecksumMismatch)
+	}
+
+	profileImages, err := s.processStoredImage(ctx, key)
+	s.deleteImages(ctx, stored)
+	if err != nil {
+		return models.User{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	user, err := s.db.UpdateUser(ctx, userID, models.UserUpdate{ProfileImages: profileImages})
+	if err != nil {
+		s.deleteImages(ctx, profileImages)
+		return models.User{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.deleteImages(ctx, oldImages)
+
+	err = s.presignImage(ctx, &user)
+	if err != nil {
+		return models.User{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return user, nil
+}
+
+// CreateAvatarUpload returns a presigned policy for uploading an avatar
+// directly to storage. The object lands under a prefix owned by the user
+// and is attached only by ConfirmAvatarUpload.
+func (s *Service) CreateAvatarUpload(ctx context.Context, id string, contentType string) (models.PresignedUpload, error) {
+	const op = "service.CreateAvatarUpload"
+
+	userID, err := uuid.Parse(id)
+	if err != nil {
+		return models.PresignedUpload{}, fmt.Errorf("%s: %w: %w", op, errs.ErrInvalidID, err)
+	}
+
+	if !slices.Contains(imageproc.ContentTypes, contentType) {
+		return models.PresignedUpload{}, fmt.Errorf("%s: %w", op, errs.ErrInvalidImage)
+	}
+
+	upload, err := s.s3.PresignUpload(ctx, uploadKey(userID, uuid.New()), contentType, s.imageProcessor.MaxBytes())
+	if err != nil {
+		return models.PresignedUpload{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return upload, nil
+}
+
+// ConfirmAvatarUpload checks an object uploaded through CreateAvatarUpload,
+// processes it into the usual avatar variants and makes those the user's
+// avatar. The uploaded object itself is removed either way.
+func (s *Service) ConfirmAvatarUpload(ctx context.Context, id string, key string) (models.User, error) {
+	const op = "service.ConfirmAvatarUpload"
+
+	userID, err := uuid.Parse(id)
+	if err != nil {
+		return models.User{}, fmt.Errorf("%s: %w: %w", op, errs.ErrInvalidID, err)
+	}
+
+	if !strings.HasPrefix(key, uploadPrefix(userID)) {
+		return models.User{}, fmt.Errorf("%s: %w", op, errs.ErrUploadNotFound)
+	}
+
+	image, err := s.s3.StatImage(ctx, key)
+	if err != nil {
+		return models.User{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	header, err := s.s3.ReadImageHeader(ctx, key, sniffLen)
+	if err != nil {
+		return models.User{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	uploaded := map[string]string{"original": key}
+
+	err = s.imageProcessor.ValidateStream(image.ContentType, image.Size, header)
+	if err != nil {
+		s.deleteImages(ctx, uploaded)
+		return models.User{}, fmt.Errorf("%s: %w", op, imageError(err))
+	}
+
+	profileImages, err := s.processStoredImage(ctx, key)
+	s.deleteImages(ctx, uploaded)
+	if err != nil {
+		return models.User{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	oldImages, err := s.db.GetProfileImages(ctx, userID)
+	if err != nil {
+		s.deleteImages(ctx, profileImages)
+		return models.User{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	user, err := s.db.UpdateUser(ctx, userID, models.UserUpdate{ProfileImages: profileImages})
+	if err != nil {
+		s.deleteImages(ctx, profileImages)
+		return models.User{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	s.deleteImages(ctx, oldImages)
+
+	err = s.presignImage(ctx, &user)
+	if err != nil {
+		return models.User{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return user, nil
+}
+
+// purgeBatchSize is how many deleted users one purge run looks at.
+const purgeBatchSize = 100
+
+// processBatchSize is how many unprocessed avatars one run looks at.
+const processBatchSize = 20
+
+// DeleteUser soft deletes the user. The account can be restored during the
+// grace period, after which PurgeDeletedUsers removes it with its avatar.
 func (s *Service) DeleteUser(ctx context.Context, id string) error {
 	const op = "service.DeleteUser"
 
-	uuid, err := uuid.FromBytes([]byte(id))
+	uuid, err := uuid.Parse(id)
+	if err != nil {
+		return fmt.Errorf("%s: %w: %w", op, errs.ErrInvalidID, err)
+	}
+
+	err = s.db.DeleteUser(ctx, uuid)
 	if err != nil {
 		return fmt.Errorf("%s: %w", op, err)
 	}
 
-	profileImageUrl, err := s.db.DeleteUser(ctx, uuid)
+	return nil
+}
+
+// RestoreUser brings back a user deleted within the grace period. Deleted
+// users give up their email and username, so restoring fails if someone
+// has taken either since.
+func (s *Service) RestoreUser(ctx context.Context, id string) error {
+	const op = "service.RestoreUser"
+
+	userID, err := uuid.Parse(id)
+	if err != nil {
+		return fmt.Errorf("%s: %w: %w", op, errs.ErrInvalidID, err)
+	}
+
+	deletedAfter := time.Now().Add(-s.users.DeleteGracePeriod).Unix()
+
+	err = s.db.RestoreUser(ctx, userID, deletedAfter)
 	if err != nil {
 		return fmt.Errorf("%s: %w", op, err)
 	}
 
-	err = s.s3.DeleteImage(ctx, profileImageUrl)
+	return nil
+}
+
+// PurgeDeletedUsers permanently removes users whose grace period is over,
+// along with their avatars, and returns how many were removed. Avatars
+// that fail to delete are left to CollectOrphanImages.
+func (s *Service) PurgeDeletedUsers(ctx context.Context) (int, error) {
+	const op = "service.PurgeDeletedUsers"
+
+	deletedBefore := time.Now().Add(-s.users.DeleteGracePeriod).Unix()
+
+	purged := 0
+	for {
+		ids, err := s.db.DeletedUsers(ctx, deletedBefore, purgeBatchSize)
+		if err != nil {
+			return purged, fmt.Errorf("%s: %w", op, err)
+		}
+
+		for _, id := range ids {
+			profileImages, err := s.db.PurgeUser(ctx, id, deletedBefore)
+			if err != nil {
+				if errors.Is(err, errs.ErrUserNotFound) {
+					continue
+				}
+				return purged, fmt.Errorf("%s: %w", op, err)
+			}
+
+			s.deleteImages(ctx, profileImages)
+			purged++
+		}
+
+		if len(ids) < purgeBatchSize {
+			return purged, nil
+		}
+	}
+}
+
+// ProcessOriginalAvatars replaces avatars that are still stored as they
+// were uploaded, by earlier versions of the avatar uploads or by the image
+// key migration, with processed variants. It handles one batch per call
+// and returns how many avatars it replaced. Originals that are too large
+// or can't be decoded stay in place and are skipped from then on.
+func (s *Service) ProcessOriginalAvatars(ctx context.Context) (int, error) {
+	const op = "service.ProcessOriginalAvatars"
+
+	users, err := s.db.UsersWithOriginalAvatars(ctx, processBatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	processed := 0
+	for _, user := range users {
+		original := map[string]string{"original": user.ProfileImages["original"]}
+		update := models.UserUpdate{ExpectedVersion: &user.Version, KeepVersion: true}
+
+		profileImages, err := s.processStoredImage(ctx, original["original"])
+		switch {
+		case err == nil:
+			update.ProfileImages = profileImages
+		case errors.Is(err, errs.ErrInvalidImage), errors.Is(err, errs.ErrImageTooLarge):
+			sl.GetFromCtx(ctx).Info(ctx, "skipping original avatar",
+				slog.String("user_id", user.ID.String()),
+				sl.Err(err),
+			)
+			err = s.db.SkipOriginalAvatar(ctx, user.ID, original["original"])
+			if err != nil && !errors.Is(err, errs.ErrUserNotFound) {
+				return processed, fmt.Errorf("%s: %w", op, err)
+			}
+			continue
+		default:
+			sl.GetFromCtx(ctx).Error(ctx, "failed to process avatar",
+				slog.String("user_id", user.ID.String()),
+				sl.Err(err),
+			)
+			continue
+		}
+
+		_, err = s.db.UpdateUser(ctx, user.ID, update)
+		if err != nil {
+			s.deleteImages(ctx, profileImages)
+			// The user changed or dropped the avatar meanwhile.
+			if errors.Is(err, errs.ErrVersionConflict) || errors.Is(err, errs.ErrUserNotFound) {
+				continue
+			}
+			return processed, fmt.Errorf("%s: %w", op, err)
+		}
+
+		s.deleteImages(ctx, original)
+		processed++
+	}
+
+	return processed, nil
+}
+
+// saveImage uploads every variant of image and returns their object keys.
+// A nil image means the default avatar and yields no keys.
+func (s *Service) saveImage(ctx context.Context, image *models.Image) (map[string]string, error) {
+	const op = "service.saveImage"
+
+	if image == nil {
+		return nil, nil
+	}
+
+	variants, err := s.imageProcessor.Process(image.Data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, imageError(err))
+	}
+
+	keys := make(map[string]string, len(variants))
+	for _, variant := range variants {
+		key := fmt.Sprintf("%s/%d.png", image.ID, variant.Size)
+
+		err := s.s3.SaveImage(ctx, key, variant.Data, imageproc.ContentType)
+		if err != nil {
+			s.deleteImages(ctx, keys)
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+
+		keys[strconv.Itoa(variant.Size)] = key
+	}
+
+	return keys, nil
+}
+
+// processStoredImage makes the usual avatar variants of an object that was
+// stored as uploaded and returns their keys. Only the variants may be
+// served: decoding and re-encoding drops EXIF, such as GPS positions, and
+// any other metadata of the upload.
+func (s *Service) processStoredImage(ctx context.Context, key string) (map[string]string, error) {
+	const op = "service.processStoredImage"
+
+	object, err := s.s3.OpenImage(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer object.Close()
+
+	// One byte over the limit is enough for Process to reject the image.
+	data, err := io.ReadAll(io.LimitReader(object, s.imageProcessor.MaxBytes()+1))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	keys, err := s.saveImage(ctx, &models.Image{ID: uuid.New(), Data: data})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return keys, nil
+}
+
+// uploadPrefix is where direct uploads of the user are placed, so that a
+// user can only confirm objects they were allowed to upload.
+func uploadPrefix(userID uuid.UUID) string {
+	return fmt.Sprintf("uploads/%s/", userID)
+}
+
+func uploadKey(userID uuid.UUID, uploadID uuid.UUID) string {
+	return uploadPrefix(userID) + uploadID.String()
+}
+
+// imageError translates image processing failures into domain errors.
+func imageError(err error) error {
+	switch {
+	case errors.Is(err, imageproc.ErrTooLarge):
+		return errs.ErrImageTooLarge
+	case errors.Is(err, imageproc.ErrUnsupportedFormat):
+		return errs.ErrInvalidImage
+	default:
+		return err
+	}
+}
+
+func usernameError(err error) error {
+	if errors.Is(err, usernamepkg.ErrReserved) {
+		return errs.ErrUsernameReserved
+	}
+
+	return fmt.Errorf("%w: %w", errs.ErrInvalidUsername, err)
+}
+
+// presignImage sets user.ProfileImageUrl to a fresh url of the largest
+// avatar variant, or of the default avatar when the user has none.
+func (s *Service) presignImage(ctx context.Context, user *models.User) error {
+	const op = "service.presignImage"
+
+	var url string
+	var err error
+
+	key := largestImage(user.ProfileImages)
+	if key == "" {
+		url, err = s.s3.DefaultImageUrl(ctx)
+	} else {
+		url, err = s.s3.GetImageUrl(ctx, key)
+	}
 	if err != nil {
 		return fmt.Errorf("%s: %w", op, err)
 	}
 
+	user.ProfileImageUrl = &url
+
 	return nil
 }
+
+// largestImage picks the key of the biggest variant. Variants named by
+// anything other than their size, such as migrated originals, are used
+// only when there is nothing else.
+func largestImage(images map[string]string) string {
+	key := ""
+	largest := -1
+	for variant, k := range images {
+		size, err := strconv.Atoi(variant)
+		if err != nil {
+			size = 0
+		}
+		if size > largest {
+			key = k
+			largest = size
+		}
+	}
+
+	return key
+}
+
+// deleteImages removes images that are no longer referenced. It is best
+// effort, failures are only logged and left to CollectOrphanImages.
+func (s *Service) deleteImages(ctx context.Context, keys map[string]string) {
+	for _, key := range keys {
+		if err := s.s3.DeleteImage(ctx, key); err != nil {
+			sl.GetFromCtx(ctx).Error(ctx, "failed to delete image", slog.String("key", key), sl.Err(err))
+		}
+	}
+}
+
+// CollectOrphanImages deletes objects that no user references. Objects
+// younger than gracePeriod are kept, they may belong to an update that has
+// not reached the database yet.
+func (s *Service) CollectOrphanImages(ctx context.Context, gracePeriod time.Duration) (int, error) {
+	const op = "service.CollectOrphanImages"
+
+	images, err := s.s3.ListImages(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	referenced, err := s.db.ReferencedImageKeys(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	deleted := 0
+	threshold := time.Now().Add(-gracePeriod)
+	for _, image := range images {
+		if _, ok := referenced[image.Key]; ok || image.LastModified.After(threshold) {
+			continue
+		}
+
+		err = s.s3.DeleteImage(ctx, image.Key)
+		if err != nil {
+			return deleted, fmt.Errorf("%s: %w", op, err)
+		}
+		deleted++
+	}
+
+	return deleted, nil
+}
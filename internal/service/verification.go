@@ -0,0 +1,241 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"time"
+
+	errs "github.com/AlexMickh/speak-user/internal/domain/errors"
+	"github.com/AlexMickh/speak-user/internal/domain/models"
+	"github.com/AlexMickh/speak-user/pkg/sl"
+	"github.com/google/uuid"
+)
+
+//go:generate mockgen -destination mocks/token_signer_mock.go github.com/AlexMickh/speak-user/internal/service TokenSigner
+type TokenSigner interface {
+	Generate() (token string, hash string, err error)
+	Verify(token string) (hash string, err error)
+}
+
+//go:generate mockgen -destination mocks/notifier_mock.go github.com/AlexMickh/speak-user/internal/service Notifier
+type Notifier interface {
+	SendEmailVerification(ctx context.Context, email string, token string) error
+	SendEmailChange(ctx context.Context, email string, token string) error
+}
+
+// VerifyEmail consumes a verification token and marks the email of its
+// owner as verified. Each token works once and only until it expires.
+// All token flows fail with ErrTokensDisabled until a secret is set.
+func (s *Service) VerifyEmail(ctx context.Context, token string) error {
+	const op = "service.VerifyEmail"
+
+	if s.verification.Secret == "" {
+		return fmt.Errorf("%s: %w", op, errs.ErrTokensDisabled)
+	}
+
+	hash, err := s.signer.Verify(token)
+	if err != nil {
+		return fmt.Errorf("%s: %w: %w", op, errs.ErrTokenNotFound, err)
+	}
+
+	verification, err := s.db.UseVerificationToken(ctx, hash, models.TokenPurposeEmailVerification)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	err = s.db.ChangeEmailVerified(ctx, verification.UserID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// ResendVerification issues a new token for an unverified email. Earlier
+// tokens stop working, and a new one can be requested only once per
+// cooldown.
+func (s *Service) ResendVerification(ctx context.Context, email string) error {
+	const op = "service.ResendVerification"
+
+	if s.verification.Secret == "" {
+		return fmt.Errorf("%s: %w", op, errs.ErrTokensDisabled)
+	}
+
+	user, err := s.db.GetUser(ctx, email)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if user.IsEmailVerified {
+		return fmt.Errorf("%s: %w", op, errs.ErrEmailVerified)
+	}
+
+	err = s.checkCooldown(ctx, user.ID, models.TokenPurposeEmailVerification)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	err = s.sendVerification(ctx, user.ID, user.Email)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// RequestEmailChange remembers newEmail as pending and sends a token to
+// it. The current email keeps working until ConfirmEmailChange. newEmail
+// must be a bare address, anything else fails with ErrInvalidEmail.
+func (s *Service) RequestEmailChange(ctx context.Context, id string, newEmail string) error {
+	const op = "service.RequestEmailChange"
+
+	if s.verification.Secret == "" {
+		return fmt.Errorf("%s: %w", op, errs.ErrTokensDisabled)
+	}
+
+	userID, err := uuid.Parse(id)
+	if err != nil {
+		return fmt.Errorf("%s: %w: %w", op, errs.ErrInvalidID, err)
+	}
+
+	addr, err := mail.ParseAddress(newEmail)
+	if err != nil {
+		return fmt.Errorf("%s: %w: %w", op, errs.ErrInvalidEmail, err)
+	}
+	if addr.Name != "" {
+		return fmt.Errorf("%s: %w", op, errs.ErrInvalidEmail)
+	}
+	newEmail = addr.Address
+
+	_, err = s.db.GetUser(ctx, newEmail)
+	if err == nil {
+		return fmt.Errorf("%s: %w", op, errs.ErrEmailTaken)
+	}
+	if !errors.Is(err, errs.ErrUserNotFound) {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	err = s.checkCooldown(ctx, userID, models.TokenPurposeEmailChange)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	err = s.db.SetPendingEmail(ctx, userID, newEmail)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	token, err := s.issueToken(ctx, userID, models.TokenPurposeEmailChange, newEmail)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	err = s.notifier.SendEmailChange(ctx, newEmail, token)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// ConfirmEmailChange consumes an email change token and switches the user
+// to the pending email. The unique email index still applies, so the
+// change fails if someone took the address in the meantime.
+func (s *Service) ConfirmEmailChange(ctx context.Context, token string) error {
+	const op = "service.ConfirmEmailChange"
+
+	if s.verification.Secret == "" {
+		return fmt.Errorf("%s: %w", op, errs.ErrTokensDisabled)
+	}
+
+	hash, err := s.signer.Verify(token)
+	if err != nil {
+		return fmt.Errorf("%s: %w: %w", op, errs.ErrTokenNotFound, err)
+	}
+
+	change, err := s.db.UseVerificationToken(ctx, hash, models.TokenPurposeEmailChange)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	err = s.db.ChangeEmail(ctx, change.UserID, change.Email)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+func (s *Service) checkCooldown(ctx context.Context, userID uuid.UUID, purpose string) error {
+	const op = "service.checkCooldown"
+
+	last, err := s.db.LastVerificationToken(ctx, userID, purpose)
+	if errors.Is(err, errs.ErrTokenNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if time.Since(last.CreatedAt) < s.verification.ResendCooldown {
+		return fmt.Errorf("%s: %w", op, errs.ErrTooManyRequests)
+	}
+
+	return nil
+}
+
+// issueToken creates a token for purpose and stores its hash, replacing
+// any unused token the user had for the same purpose.
+func (s *Service) issueToken(ctx context.Context, userID uuid.UUID, purpose string, email string) (string, error) {
+	const op = "service.issueToken"
+
+	token, hash, err := s.signer.Generate()
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	now := time.Now()
+	err = s.db.SaveVerificationToken(ctx, models.VerificationToken{
+		Hash:      hash,
+		UserID:    userID,
+		Purpose:   purpose,
+		Email:     email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.verification.TTL),
+	})
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	return token, nil
+}
+
+func (s *Service) sendVerification(ctx context.Context, userID uuid.UUID, email string) error {
+	const op = "service.sendVerification"
+
+	token, err := s.issueToken(ctx, userID, models.TokenPurposeEmailVerification, email)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	err = s.notifier.SendEmailVerification(ctx, email, token)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// sendInitialVerification is called after sign up. A failure must not undo
+// the registration, the user can always ask for another token.
+func (s *Service) sendInitialVerification(ctx context.Context, userID uuid.UUID, email string) {
+	if s.verification.Secret == "" {
+		return
+	}
+
+	if err := s.sendVerification(ctx, userID, email); err != nil {
+		sl.GetFromCtx(ctx).Error(ctx, "failed to send email verification", sl.Err(err))
+	}
+}
@@ -0,0 +1,47 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	errs "github.com/AlexMickh/speak-user/internal/domain/errors"
+	"github.com/AlexMickh/speak-user/internal/domain/models"
+	"github.com/google/uuid"
+)
+
+// WatchUsers sends every change of the given users, or of all users when
+// ids is empty, to send until ctx is done. Passing the ResumeToken of the
+// last received change continues the feed without gaps after a reconnect.
+func (s *Service) WatchUsers(
+	ctx context.Context,
+	ids []string,
+	resumeToken string,
+	send func(change models.UserChange) error,
+) error {
+	const op = "service.WatchUsers"
+
+	userIDs := make([]uuid.UUID, 0, len(ids))
+	for _, id := range ids {
+		userID, err := uuid.Parse(id)
+		if err != nil {
+			return fmt.Errorf("%s: %w: %w", op, errs.ErrInvalidID, err)
+		}
+		userIDs = append(userIDs, userID)
+	}
+
+	err := s.db.WatchUsers(ctx, userIDs, resumeToken, func(change models.UserChange) error {
+		if change.User != nil {
+			change.User.Password = ""
+			if err := s.presignImage(ctx, change.User); err != nil {
+				return err
+			}
+		}
+
+		return send(change)
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
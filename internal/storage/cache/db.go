@@ -0,0 +1,211 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	errs "github.com/AlexMickh/speak-user/internal/domain/errors"
+	"github.com/AlexMickh/speak-user/internal/domain/models"
+	"github.com/AlexMickh/speak-user/internal/service"
+	"github.com/AlexMickh/speak-user/pkg/sl"
+	"github.com/google/uuid"
+	"golang.org/x/sync/singleflight"
+)
+
+// entry is what gets cached. Missing marks a user known not to exist, so
+// lookups of unknown users don't reach the database every time either.
+type entry[T any] struct {
+	Missing bool `json:"missing,omitempty"`
+	Value   T    `json:"value"`
+}
+
+// DB is a read-through cache in front of a service.DB. Users are cached by
+// id, and lookups by id come without the password hash. GetUser, which
+// login goes through, always reads the database. Writes drop the entries they make stale.
+// Concurrent misses of one key share a single database lookup.
+type DB struct {
+	service.DB
+	cache       Cache
+	ttl         time.Duration
+	negativeTTL time.Duration
+	group       singleflight.Group
+	// generation grows on every invalidation. A lookup that raced with one
+	// may have read the old document, so it doesn't fill the cache.
+	generation atomic.Uint64
+}
+
+func NewDB(db service.DB, cache Cache, ttl time.Duration, negativeTTL time.Duration) *DB {
+	return &DB{
+		DB:          db,
+		cache:       cache,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+	}
+}
+
+func userKey(id uuid.UUID) string {
+	return "user:id:" + id.String()
+}
+
+func profileKey(id uuid.UUID) string {
+	return "user:profile:" + id.String()
+}
+
+func (d *DB) GetUserByID(ctx context.Context, id uuid.UUID) (models.User, error) {
+	const op = "storage.cache.GetUserByID"
+
+	user, err := readThrough(ctx, d, userKey(id), func(ctx context.Context) (models.User, error) {
+		return d.DB.GetUserByID(ctx, id)
+	})
+	if err != nil {
+		return models.User{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return user, nil
+}
+
+func (d *DB) GetPublicProfile(ctx context.Context, id uuid.UUID) (models.PublicProfile, error) {
+	const op = "storage.cache.GetPublicProfile"
+
+	profile, err := readThrough(ctx, d, profileKey(id), func(ctx context.Context) (models.PublicProfile, error) {
+		return d.DB.GetPublicProfile(ctx, id)
+	})
+	if err != nil {
+		return models.PublicProfile{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return profile, nil
+}
+
+func (d *DB) SaveUser(ctx context.Context, user models.User) error {
+	d.invalidate(ctx, user.ID)
+	defer d.invalidate(ctx, user.ID)
+	return d.DB.SaveUser(ctx, user)
+}
+
+func (d *DB) ChangeEmailVerified(ctx context.Context, id uuid.UUID) error {
+	d.invalidate(ctx, id)
+	defer d.invalidate(ctx, id)
+	return d.DB.ChangeEmailVerified(ctx, id)
+}
+
+func (d *DB) ChangeEmail(ctx context.Context, id uuid.UUID, email string) error {
+	d.invalidate(ctx, id)
+	defer d.invalidate(ctx, id)
+	return d.DB.ChangeEmail(ctx, id, email)
+}
+
+func (d *DB) UpdatePassword(ctx context.Context, id uuid.UUID, password string) error {
+	d.invalidate(ctx, id)
+	defer d.invalidate(ctx, id)
+	return d.DB.UpdatePassword(ctx, id, password)
+}
+
+func (d *DB) UpdateUser(ctx context.Context, id uuid.UUID, data models.UserUpdate) (models.User, error) {
+	d.invalidate(ctx, id)
+	defer d.invalidate(ctx, id)
+	return d.DB.UpdateUser(ctx, id, data)
+}
+
+func (d *DB) DeleteUser(ctx context.Context, id uuid.UUID) error {
+	d.invalidate(ctx, id)
+	defer d.invalidate(ctx, id)
+	return d.DB.DeleteUser(ctx, id)
+}
+
+func (d *DB) RestoreUser(ctx context.Context, id uuid.UUID, deletedAfter int64) error {
+	d.invalidate(ctx, id)
+	defer d.invalidate(ctx, id)
+	return d.DB.RestoreUser(ctx, id, deletedAfter)
+}
+
+func (d *DB) PurgeUser(ctx context.Context, id uuid.UUID, deletedBefore int64) (map[string]string, error) {
+	d.invalidate(ctx, id)
+	defer d.invalidate(ctx, id)
+	return d.DB.PurgeUser(ctx, id, deletedBefore)
+}
+
+// invalidate drops everything cached about the user. Writes call it both
+// before and after they touch the database: the first call makes new reads
+// miss, the second drops whatever a lookup that read the old document
+// managed to store in between.
+func (d *DB) invalidate(ctx context.Context, id uuid.UUID) {
+	d.generation.Add(1)
+	d.group.Forget(userKey(id))
+	d.group.Forget(profileKey(id))
+	d.delete(ctx, userKey(id), profileKey(id))
+}
+
+func (d *DB) delete(ctx context.Context, keys ...string) {
+	if err := d.cache.Delete(ctx, keys...); err != nil {
+		sl.GetFromCtx(ctx).Error(ctx, "failed to invalidate cache", sl.Err(err))
+	}
+}
+
+func (d *DB) set(ctx context.Context, key string, value any, ttl time.Duration) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		sl.GetFromCtx(ctx).Error(ctx, "failed to encode cache entry", sl.Err(err))
+		return
+	}
+
+	if err := d.cache.Set(ctx, key, data, ttl); err != nil {
+		sl.GetFromCtx(ctx).Error(ctx, "failed to fill cache", sl.Err(err))
+	}
+}
+
+// readThrough returns the cached value of key, loading and caching it on a
+// miss. A broken cache only costs the lookup, it never fails the read.
+func readThrough[T any](
+	ctx context.Context,
+	d *DB,
+	key string,
+	load func(ctx context.Context) (T, error),
+) (T, error) {
+	var zero T
+
+	data, err := d.cache.Get(ctx, key)
+	if err == nil {
+		var cached entry[T]
+		if err := json.Unmarshal(data, &cached); err == nil {
+			if cached.Missing {
+				return zero, errs.ErrUserNotFound
+			}
+			return cached.Value, nil
+		}
+	} else if !errors.Is(err, ErrMiss) {
+		sl.GetFromCtx(ctx).Error(ctx, "failed to read cache", sl.Err(err))
+	}
+
+	// The shared lookup must not be cancelled together with whichever
+	// request happened to start it.
+	loadCtx := context.WithoutCancel(ctx)
+
+	res, err, _ := d.group.Do(key, func() (any, error) {
+		generation := d.generation.Load()
+
+		value, err := load(loadCtx)
+		if d.generation.Load() != generation {
+			return value, err
+		}
+		if err != nil {
+			if errors.Is(err, errs.ErrUserNotFound) {
+				d.set(loadCtx, key, entry[T]{Missing: true}, d.negativeTTL)
+			}
+			return zero, err
+		}
+
+		d.set(loadCtx, key, entry[T]{Value: value}, d.ttl)
+
+		return value, nil
+	})
+	if err != nil {
+		return zero, err
+	}
+
+	return res.(T), nil
+}
@@ -0,0 +1,68 @@
+package cache
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type memoryEntry struct {
+	value     []byte
+	expiresAt time.Time
+}
+
+// Memory is a Cache kept in process memory. It suits tests and single
+// instance setups, since nothing is shared between replicas.
+type Memory struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		entries: make(map[string]memoryEntry),
+	}
+}
+
+func (m *Memory) Get(_ context.Context, key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.entries[key]
+	if !ok {
+		return nil, ErrMiss
+	}
+	if time.Now().After(entry.expiresAt) {
+		delete(m.entries, key)
+		return nil, ErrMiss
+	}
+
+	return entry.value, nil
+}
+
+func (m *Memory) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.entries[key] = memoryEntry{
+		value:     value,
+		expiresAt: time.Now().Add(ttl),
+	}
+
+	return nil
+}
+
+func (m *Memory) Delete(_ context.Context, keys ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, key := range keys {
+		delete(m.entries, key)
+	}
+
+	return nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
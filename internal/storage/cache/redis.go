@@ -0,0 +1,79 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/AlexMickh/speak-user/internal/config"
+	"github.com/AlexMickh/speak-user/pkg/utils/retry"
+	"github.com/redis/go-redis/v9"
+)
+
+type Redis struct {
+	rdb *redis.Client
+}
+
+func NewRedis(ctx context.Context, cfg config.RedisConfig) (*Redis, error) {
+	const op = "storage.cache.NewRedis"
+
+	rdb := redis.NewClient(&redis.Options{
+		Addr:     cfg.Addr,
+		Username: cfg.User,
+		Password: cfg.Password,
+		DB:       cfg.DB,
+	})
+
+	err := retry.WithDelay(5, 500*time.Millisecond, func() error {
+		return rdb.Ping(ctx).Err()
+	})
+	if err != nil {
+		rdb.Close()
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return &Redis{
+		rdb: rdb,
+	}, nil
+}
+
+func (r *Redis) Get(ctx context.Context, key string) ([]byte, error) {
+	const op = "storage.cache.Redis.Get"
+
+	value, err := r.rdb.Get(ctx, key).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, ErrMiss
+		}
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return value, nil
+}
+
+func (r *Redis) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	const op = "storage.cache.Redis.Set"
+
+	err := r.rdb.Set(ctx, key, value, ttl).Err()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+func (r *Redis) Delete(ctx context.Context, keys ...string) error {
+	const op = "storage.cache.Redis.Delete"
+
+	err := r.rdb.Del(ctx, keys...).Err()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+func (r *Redis) Close() error {
+	return r.rdb.Close()
+}
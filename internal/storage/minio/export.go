@@ -0,0 +1,102 @@
+package minio
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"time"
+
+	errs "github.com/AlexMickh/speak-user/internal/domain/errors"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/lifecycle"
+)
+
+const exportContentType = "application/zip"
+
+// createExportBucket makes sure the export bucket exists and drops
+// archives after retentionDays, so nobody has to clean them up.
+func createExportBucket(ctx context.Context, mc *minio.Client, bucket string, retentionDays int) error {
+	exists, err := mc.BucketExists(ctx, bucket)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		err = mc.MakeBucket(ctx, bucket, minio.MakeBucketOptions{})
+		if err != nil {
+			return err
+		}
+	}
+
+	cfg := lifecycle.NewConfiguration()
+	cfg.Rules = []lifecycle.Rule{
+		{
+			ID:     "expire-exports",
+			Status: "Enabled",
+			Expiration: lifecycle.Expiration{
+				Days: lifecycle.ExpirationDays(retentionDays),
+			},
+		},
+	}
+
+	return mc.SetBucketLifecycle(ctx, bucket, cfg)
+}
+
+// OpenImage streams an object of the image bucket. The caller must close
+// the returned reader.
+func (m *Minio) OpenImage(ctx context.Context, key string) (io.ReadCloser, error) {
+	const op = "storage.minio.OpenImage"
+
+	object, err := m.mc.GetObject(ctx, m.bucketName, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return object, nil
+}
+
+func (m *Minio) SaveExport(ctx context.Context, key string, r io.Reader, size int64) error {
+	const op = "storage.minio.SaveExport"
+
+	_, err := m.mc.PutObject(
+		ctx,
+		m.exportBucket,
+		key,
+		r,
+		size,
+		minio.PutObjectOptions{ContentType: exportContentType},
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// ExportUrl presigns a download of an export archive. The url makes
+// browsers save the file rather than open it. An archive the bucket
+// lifecycle already removed yields ErrExportNotFound.
+func (m *Minio) ExportUrl(ctx context.Context, key string) (string, time.Time, error) {
+	const op = "storage.minio.ExportUrl"
+
+	_, err := m.mc.StatObject(ctx, m.exportBucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return "", time.Time{}, fmt.Errorf("%s: %w", op, errs.ErrExportNotFound)
+		}
+		return "", time.Time{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	params := url.Values{}
+	params.Set("response-content-disposition", fmt.Sprintf("attachment; filename=%q", path.Base(key)))
+
+	expiresAt := time.Now().Add(m.exportUrlTTL)
+
+	u, err := m.mc.PresignedGetObject(ctx, m.exportBucket, key, m.exportUrlTTL, params)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return u.String(), expiresAt, nil
+}
@@ -4,9 +4,11 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"time"
 
 	"github.com/AlexMickh/speak-user/internal/config"
+	errs "github.com/AlexMickh/speak-user/internal/domain/errors"
 	"github.com/AlexMickh/speak-user/internal/domain/models"
 	"github.com/AlexMickh/speak-user/pkg/utils/retry"
 	"github.com/minio/minio-go/v7"
@@ -14,13 +16,18 @@ import (
 )
 
 type Minio struct {
-	mc         *minio.Client
-	bucketName string
+	mc           *minio.Client
+	bucketName   string
+	uploadTTL    time.Duration
+	exportBucket string
+	exportUrlTTL time.Duration
 }
 
-const defaultImage = "avatar.png"
+const DefaultImage = "avatar.png"
 
-func New(ctx context.Context, cfg config.MinioConfig) (*Minio, error) {
+// New connects to minio and makes sure the buckets exist. The export
+// bucket is only set up when exports are enabled.
+func New(ctx context.Context, cfg config.MinioConfig, exports bool) (*Minio, error) {
 	const op = "storage.minio.New"
 
 	var mc *minio.Client
@@ -47,6 +54,13 @@ func New(ctx context.Context, cfg config.MinioConfig) (*Minio, error) {
 			}
 		}
 
+		if exports {
+			err = createExportBucket(ctx, mc, cfg.ExportBucketName, cfg.ExportRetentionDays)
+			if err != nil {
+				return fmt.Errorf("%s: %w", op, err)
+			}
+		}
+
 		return nil
 	})
 	if err != nil {
@@ -54,38 +68,55 @@ func New(ctx context.Context, cfg config.MinioConfig) (*Minio, error) {
 	}
 
 	return &Minio{
-		mc:         mc,
-		bucketName: cfg.BucketName,
+		mc:           mc,
+		bucketName:   cfg.BucketName,
+		uploadTTL:    cfg.UploadTTL,
+		exportBucket: cfg.ExportBucketName,
+		exportUrlTTL: cfg.ExportUrlTTL,
 	}, nil
 }
 
-func (m *Minio) SaveImage(ctx context.Context, image *models.Image) (string, error) {
+func (m *Minio) SaveImage(ctx context.Context, key string, data []byte, contentType string) error {
 	const op = "storage.minio.SaveImage"
 
-	if image == nil {
-		url, err := m.GetImageUrl(ctx, defaultImage)
-		if err != nil {
-			return "", fmt.Errorf("%s: %w", op, err)
-		}
-
-		return url, nil
+	err := m.SaveImageStream(ctx, key, bytes.NewReader(data), int64(len(data)), contentType)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
 	}
 
-	reader := bytes.NewReader(image.Data)
+	return nil
+}
+
+// SaveImageStream uploads exactly size bytes read from r without holding
+// the whole image in memory.
+func (m *Minio) SaveImageStream(
+	ctx context.Context,
+	key string,
+	r io.Reader,
+	size int64,
+	contentType string,
+) error {
+	const op = "storage.minio.SaveImageStream"
 
 	_, err := m.mc.PutObject(
 		ctx,
 		m.bucketName,
-		image.ID.String(),
-		reader,
-		int64(len(image.Data)),
-		minio.PutObjectOptions{ContentType: "image/png"},
+		key,
+		r,
+		size,
+		minio.PutObjectOptions{ContentType: contentType},
 	)
 	if err != nil {
-		return "", fmt.Errorf("%s: %w", op, err)
+		return fmt.Errorf("%s: %w", op, err)
 	}
 
-	url, err := m.GetImageUrl(ctx, image.ID.String())
+	return nil
+}
+
+func (m *Minio) DefaultImageUrl(ctx context.Context) (string, error) {
+	const op = "storage.minio.DefaultImageUrl"
+
+	url, err := m.GetImageUrl(ctx, DefaultImage)
 	if err != nil {
 		return "", fmt.Errorf("%s: %w", op, err)
 	}
@@ -114,3 +145,122 @@ func (m *Minio) DeleteImage(ctx context.Context, imageId string) error {
 
 	return nil
 }
+
+func (m *Minio) ListImages(ctx context.Context) ([]models.StoredImage, error) {
+	const op = "storage.minio.ListImages"
+
+	images, err := m.ListImagesWithPrefix(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return images, nil
+}
+
+func (m *Minio) ListImagesWithPrefix(ctx context.Context, prefix string) ([]models.StoredImage, error) {
+	const op = "storage.minio.ListImagesWithPrefix"
+
+	opts := minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: true,
+	}
+
+	var images []models.StoredImage
+	for object := range m.mc.ListObjects(ctx, m.bucketName, opts) {
+		if object.Err != nil {
+			return nil, fmt.Errorf("%s: %w", op, object.Err)
+		}
+		if object.Key == DefaultImage {
+			continue
+		}
+
+		images = append(images, models.StoredImage{
+			Key:          object.Key,
+			Size:         object.Size,
+			ContentType:  object.ContentType,
+			LastModified: object.LastModified,
+		})
+	}
+
+	return images, nil
+}
+
+// PresignUpload returns a POST policy that only accepts an object under key
+// with the given content type and at most maxSize bytes.
+func (m *Minio) PresignUpload(
+	ctx context.Context,
+	key string,
+	contentType string,
+	maxSize int64,
+) (models.PresignedUpload, error) {
+	const op = "storage.minio.PresignUpload"
+
+	expiresAt := time.Now().Add(m.uploadTTL)
+
+	policy := minio.NewPostPolicy()
+	for _, err := range []error{
+		policy.SetBucket(m.bucketName),
+		policy.SetKey(key),
+		policy.SetExpires(expiresAt),
+		policy.SetContentType(contentType),
+		policy.SetContentLengthRange(1, maxSize),
+	} {
+		if err != nil {
+			return models.PresignedUpload{}, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+
+	url, formData, err := m.mc.PresignedPostPolicy(ctx, policy)
+	if err != nil {
+		return models.PresignedUpload{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return models.PresignedUpload{
+		Key:       key,
+		Url:       url.String(),
+		FormData:  formData,
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+func (m *Minio) StatImage(ctx context.Context, key string) (models.StoredImage, error) {
+	const op = "storage.minio.StatImage"
+
+	info, err := m.mc.StatObject(ctx, m.bucketName, key, minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return models.StoredImage{}, fmt.Errorf("%s: %w", op, errs.ErrUploadNotFound)
+		}
+		return models.StoredImage{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return models.StoredImage{
+		Key:          info.Key,
+		Size:         info.Size,
+		ContentType:  info.ContentType,
+		LastModified: info.LastModified,
+	}, nil
+}
+
+// ReadImageHeader returns up to n leading bytes of the object.
+func (m *Minio) ReadImageHeader(ctx context.Context, key string, n int64) ([]byte, error) {
+	const op = "storage.minio.ReadImageHeader"
+
+	opts := minio.GetObjectOptions{}
+	if err := opts.SetRange(0, n-1); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	object, err := m.mc.GetObject(ctx, m.bucketName, key, opts)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer object.Close()
+
+	header, err := io.ReadAll(object)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return header, nil
+}
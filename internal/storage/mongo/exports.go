@@ -0,0 +1,133 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	errs "github.com/AlexMickh/speak-user/internal/domain/errors"
+	"github.com/AlexMickh/speak-user/internal/domain/models"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// exportRetention is how long, in seconds, export jobs are kept. Their
+// archives expire from the bucket well before that, and GetExport reports
+// such jobs as expired meanwhile.
+const exportRetention = int32(30 * 24 * 60 * 60)
+
+// exportStaleAfter is how long a job may stay running before another
+// worker takes it over, assuming the first one died.
+const exportStaleAfter = 30 * time.Minute
+
+func createExportIndexes(ctx context.Context, exports *mongo.Collection) error {
+	_, err := exports.Indexes().CreateMany(
+		ctx,
+		[]mongo.IndexModel{
+			{
+				Keys: bson.D{{Key: "status", Value: 1}, {Key: "updated_at", Value: 1}},
+			},
+			{
+				Keys:    bson.D{{Key: "created_at", Value: 1}},
+				Options: options.Index().SetExpireAfterSeconds(exportRetention),
+			},
+		},
+	)
+
+	return err
+}
+
+func (s *Storage) CreateExportJob(ctx context.Context, job models.ExportJob) error {
+	const op = "storage.mongo.CreateExportJob"
+
+	_, err := s.exports.InsertOne(ctx, job)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+func (s *Storage) GetExportJob(ctx context.Context, id uuid.UUID, userID uuid.UUID) (models.ExportJob, error) {
+	const op = "storage.mongo.GetExportJob"
+
+	var job models.ExportJob
+	err := s.exports.FindOne(ctx, bson.D{{Key: "_id", Value: id}, {Key: "user_id", Value: userID}}).Decode(&job)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return models.ExportJob{}, fmt.Errorf("%s: %w", op, errs.ErrExportNotFound)
+		}
+		return models.ExportJob{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return job, nil
+}
+
+// ClaimExportJob marks the oldest pending job, or a stale running one, as
+// running and returns it. It fails with ErrExportNotFound when there is
+// nothing to do.
+func (s *Storage) ClaimExportJob(ctx context.Context) (models.ExportJob, error) {
+	const op = "storage.mongo.ClaimExportJob"
+
+	now := time.Now()
+	filter := bson.D{{Key: "$or", Value: bson.A{
+		bson.D{{Key: "status", Value: models.ExportPending}},
+		bson.D{
+			{Key: "status", Value: models.ExportRunning},
+			{Key: "updated_at", Value: bson.D{{Key: "$lt", Value: now.Add(-exportStaleAfter)}}},
+		},
+	}}}
+	update := bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: "status", Value: models.ExportRunning},
+			{Key: "updated_at", Value: now},
+		}},
+	}
+
+	var job models.ExportJob
+	err := s.exports.FindOneAndUpdate(
+		ctx,
+		filter,
+		update,
+		options.FindOneAndUpdate().
+			SetSort(bson.D{{Key: "created_at", Value: 1}}).
+			SetReturnDocument(options.After),
+	).Decode(&job)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return models.ExportJob{}, fmt.Errorf("%s: %w", op, errs.ErrExportNotFound)
+		}
+		return models.ExportJob{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return job, nil
+}
+
+// FinishExportJob records the outcome of a job. An empty errMsg means the
+// archive was stored under objectKey.
+func (s *Storage) FinishExportJob(ctx context.Context, id uuid.UUID, objectKey string, errMsg string) error {
+	const op = "storage.mongo.FinishExportJob"
+
+	set := bson.D{
+		{Key: "status", Value: models.ExportDone},
+		{Key: "object_key", Value: objectKey},
+		{Key: "updated_at", Value: time.Now()},
+	}
+	if errMsg != "" {
+		set = bson.D{
+			{Key: "status", Value: models.ExportFailed},
+			{Key: "error", Value: errMsg},
+			{Key: "updated_at", Value: time.Now()},
+		}
+	}
+
+	_, err := s.exports.UpdateByID(ctx, id, bson.D{{Key: "$set", Value: set}})
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,320 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+var (
+	ErrIrreversible = errors.New("migration can't be reverted")
+	ErrLocked       = errors.New("migrations are locked by another instance")
+	ErrLockLost     = errors.New("migration lock was taken over by another instance")
+)
+
+const (
+	migrationsCollection = "schema_migrations"
+	migrationLockID      = "lock"
+	// migrationLockTTL bounds how long a crashed instance can block
+	// migrations of the others. The holder renews the lock well before it
+	// runs out, however long its migrations take.
+	migrationLockTTL  = 2 * time.Minute
+	lockRenewalPeriod = migrationLockTTL / 4
+	lockRetryDelay    = time.Second
+)
+
+// Migration changes the shape of stored documents. Up must be idempotent,
+// since an instance can die after applying it but before recording that.
+// A nil Down means the migration can't be reverted.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(ctx context.Context, s *Storage) error
+	Down    func(ctx context.Context, s *Storage) error
+}
+
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+}
+
+type migrationRecord struct {
+	Version   int       `bson:"_id"`
+	Name      string    `bson:"name"`
+	AppliedAt time.Time `bson:"applied_at"`
+}
+
+// Migrator applies migrations in version order and records them in the
+// schema_migrations collection. A lock document in the same collection
+// makes sure only one replica migrates at a time.
+type Migrator struct {
+	storage    *Storage
+	coll       *mongo.Collection
+	migrations []Migration
+	owner      string
+}
+
+func NewMigrator(s *Storage, migrations []Migration) *Migrator {
+	host, _ := os.Hostname()
+
+	return &Migrator{
+		storage:    s,
+		coll:       s.coll.Database().Collection(migrationsCollection),
+		migrations: migrations,
+		owner:      fmt.Sprintf("%s/%s", host, uuid.New()),
+	}
+}
+
+// Up applies every pending migration and returns how many it applied.
+func (m *Migrator) Up(ctx context.Context) (int, error) {
+	const op = "storage.mongo.Migrator.Up"
+
+	applied := 0
+	err := m.withLock(ctx, func(ctx context.Context) error {
+		done, err := m.applied(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range m.migrations {
+			if _, ok := done[migration.Version]; ok {
+				continue
+			}
+
+			if err := migration.Up(ctx, m.storage); err != nil {
+				return fmt.Errorf("migration %d %s: %w", migration.Version, migration.Name, err)
+			}
+
+			_, err := m.coll.InsertOne(ctx, migrationRecord{
+				Version:   migration.Version,
+				Name:      migration.Name,
+				AppliedAt: time.Now(),
+			})
+			if err != nil {
+				return err
+			}
+			applied++
+		}
+
+		return nil
+	})
+	if err != nil {
+		return applied, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return applied, nil
+}
+
+// Down reverts the last steps applied migrations, newest first.
+func (m *Migrator) Down(ctx context.Context, steps int) (int, error) {
+	const op = "storage.mongo.Migrator.Down"
+
+	reverted := 0
+	err := m.withLock(ctx, func(ctx context.Context) error {
+		done, err := m.applied(ctx)
+		if err != nil {
+			return err
+		}
+
+		for i := len(m.migrations) - 1; i >= 0 && reverted < steps; i-- {
+			migration := m.migrations[i]
+			if _, ok := done[migration.Version]; !ok {
+				continue
+			}
+
+			if migration.Down == nil {
+				return fmt.Errorf("migration %d %s: %w", migration.Version, migration.Name, ErrIrreversible)
+			}
+			if err := migration.Down(ctx, m.storage); err != nil {
+				return fmt.Errorf("migration %d %s: %w", migration.Version, migration.Name, err)
+			}
+
+			_, err := m.coll.DeleteOne(ctx, bson.D{{Key: "_id", Value: migration.Version}})
+			if err != nil {
+				return err
+			}
+			reverted++
+		}
+
+		return nil
+	})
+	if err != nil {
+		return reverted, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return reverted, nil
+}
+
+// Status lists every known migration and when it was applied, if it was.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	const op = "storage.mongo.Migrator.Status"
+
+	done, err := m.applied(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	statuses := make([]MigrationStatus, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		status := MigrationStatus{
+			Version: migration.Version,
+			Name:    migration.Name,
+		}
+		if record, ok := done[migration.Version]; ok {
+			status.AppliedAt = &record.AppliedAt
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+// Pending returns how many known migrations are not applied yet.
+func (m *Migrator) Pending(ctx context.Context) (int, error) {
+	const op = "storage.mongo.Migrator.Pending"
+
+	done, err := m.applied(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	pending := 0
+	for _, migration := range m.migrations {
+		if _, ok := done[migration.Version]; !ok {
+			pending++
+		}
+	}
+
+	return pending, nil
+}
+
+func (m *Migrator) applied(ctx context.Context) (map[int]migrationRecord, error) {
+	cursor, err := m.coll.Find(ctx, bson.D{{Key: "_id", Value: bson.D{{Key: "$type", Value: "number"}}}})
+	if err != nil {
+		return nil, err
+	}
+
+	var records []migrationRecord
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, err
+	}
+
+	done := make(map[int]migrationRecord, len(records))
+	for _, record := range records {
+		done[record.Version] = record
+	}
+
+	return done, nil
+}
+
+// withLock runs fn while holding the migration lock, waiting for another
+// instance to release it until ctx is done. The lock is renewed while fn
+// runs, and fn is cancelled if it is lost anyway.
+func (m *Migrator) withLock(ctx context.Context, fn func(ctx context.Context) error) error {
+	for {
+		err := m.lock(ctx)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, ErrLocked) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ErrLocked
+		case <-time.After(lockRetryDelay):
+		}
+	}
+	defer m.unlock(context.WithoutCancel(ctx))
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	go m.keepLock(ctx, cancel)
+
+	if err := fn(ctx); err != nil {
+		if cause := context.Cause(ctx); errors.Is(cause, ErrLockLost) {
+			return cause
+		}
+		return err
+	}
+
+	return nil
+}
+
+// keepLock renews the lock until ctx is done. Failed renewals are retried
+// on the next tick, the lock stays valid meanwhile. Finding the lock owned
+// by someone else cancels ctx.
+func (m *Migrator) keepLock(ctx context.Context, cancel context.CancelCauseFunc) {
+	ticker := time.NewTicker(lockRenewalPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := m.renew(ctx)
+			if errors.Is(err, ErrLockLost) {
+				cancel(err)
+				return
+			}
+		}
+	}
+}
+
+func (m *Migrator) renew(ctx context.Context) error {
+	res, err := m.coll.UpdateOne(
+		ctx,
+		bson.D{{Key: "_id", Value: migrationLockID}, {Key: "owner", Value: m.owner}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "locked_until", Value: time.Now().Add(migrationLockTTL)}}}},
+	)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrLockLost
+	}
+
+	return nil
+}
+
+// lock takes the lock document over when it is missing or expired. While
+// another instance holds it, the upsert collides with the existing
+// document on _id.
+func (m *Migrator) lock(ctx context.Context) error {
+	now := time.Now()
+
+	filter := bson.D{
+		{Key: "_id", Value: migrationLockID},
+		{Key: "locked_until", Value: bson.D{{Key: "$lt", Value: now}}},
+	}
+	update := bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: "owner", Value: m.owner},
+			{Key: "locked_until", Value: now.Add(migrationLockTTL)},
+		}},
+	}
+
+	_, err := m.coll.UpdateOne(ctx, filter, update, options.UpdateOne().SetUpsert(true))
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return ErrLocked
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (m *Migrator) unlock(ctx context.Context) {
+	_, _ = m.coll.DeleteOne(ctx, bson.D{{Key: "_id", Value: migrationLockID}, {Key: "owner", Value: m.owner}})
+}
@@ -0,0 +1,268 @@
+package mongo
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+
+	"github.com/AlexMickh/speak-user/pkg/sl"
+	usernamepkg "github.com/AlexMickh/speak-user/pkg/username"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// Migrations returns every migration of the users collection in the order
+// they must be applied. Versions are never reused or reordered.
+func Migrations(bucketName string, defaultImage string) []Migration {
+	return []Migration{
+		{
+			Version: 1,
+			Name:    "profile_image_keys",
+			Up: func(ctx context.Context, s *Storage) error {
+				return s.migrateImageKeys(ctx, bucketName, defaultImage)
+			},
+		},
+		{
+			Version: 2,
+			Name:    "drop_null_descriptions",
+			Up:      dropNullDescriptions,
+			// Missing and null descriptions read the same, so there is
+			// nothing to restore.
+			Down: func(context.Context, *Storage) error { return nil },
+		},
+		{
+			Version: 3,
+			Name:    "backfill_username_keys",
+			Up:      backfillUsernameKeys,
+			// Backfilled keys can't be told apart from the ones set since,
+			// and dropping them all would undo uniqueness.
+			Down: func(context.Context, *Storage) error { return nil },
+		},
+		{
+			Version: 4,
+			Name:    "release_deleted_user_keys",
+			Up:      releaseDeletedUserKeys,
+		},
+	}
+}
+
+// migrateImageKeys rewrites documents that still hold a presigned
+// profile_image_url into profile_images object keys. The key is parsed out
+// of the url path, links to the default avatar are simply dropped. It is
+// safe to run repeatedly, migrated documents no longer match the filter.
+func (s *Storage) migrateImageKeys(ctx context.Context, bucketName string, defaultImage string) error {
+	const op = "storage.mongo.migrateImageKeys"
+
+	cursor, err := s.coll.Find(ctx, bson.D{{Key: "profile_image_url", Value: bson.D{{Key: "$exists", Value: true}}}})
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var doc struct {
+			ID              uuid.UUID         `bson:"_id"`
+			ProfileImageUrl string            `bson:"profile_image_url"`
+			ProfileImages   map[string]string `bson:"profile_images,omitempty"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+
+		update := bson.D{
+			{Key: "$unset", Value: bson.D{{Key: "profile_image_url", Value: ""}}},
+		}
+
+		key := objectKey(doc.ProfileImageUrl, bucketName)
+		if key != "" && key != defaultImage && len(doc.ProfileImages) == 0 {
+			update = append(update, bson.E{Key: "$set", Value: bson.D{
+				{Key: "profile_images", Value: map[string]string{"original": key}},
+			}})
+		}
+
+		if _, err := s.coll.UpdateByID(ctx, doc.ID, update); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// dropNullDescriptions removes the description of users that have none.
+// The bson tag of Description used to read "omitempy", so the omitempty
+// option was never applied and missing descriptions were stored as null.
+func dropNullDescriptions(ctx context.Context, s *Storage) error {
+	const op = "storage.mongo.dropNullDescriptions"
+
+	_, err := s.coll.UpdateMany(
+		ctx,
+		bson.D{{Key: "description", Value: bson.D{{Key: "$type", Value: "null"}}}},
+		bson.D{{Key: "$unset", Value: bson.D{{Key: "description", Value: ""}}}},
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// backfillUsernameKeys gives users created before usernames became unique
+// their username_normalized key. Users are handled oldest first, so the
+// first holder of a name keeps it. A user whose key is already taken keeps
+// the username without a key and is logged as a conflict, to be renamed by
+// hand or on their next profile update.
+func backfillUsernameKeys(ctx context.Context, s *Storage) error {
+	const op = "storage.mongo.backfillUsernameKeys"
+
+	cursor, err := s.coll.Find(
+		ctx,
+		bson.D{
+			{Key: "username", Value: bson.D{{Key: "$type", Value: "string"}}},
+			{Key: "username_normalized", Value: bson.D{{Key: "$exists", Value: false}}},
+		},
+		options.Find().
+			SetSort(bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}).
+			SetProjection(bson.D{{Key: "username", Value: 1}}),
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer cursor.Close(ctx)
+
+	backfilled, conflicts := 0, 0
+	for cursor.Next(ctx) {
+		var doc struct {
+			ID       uuid.UUID `bson:"_id"`
+			Username string    `bson:"username"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+
+		key := usernamepkg.Key(doc.Username)
+		if key == "" {
+			continue
+		}
+
+		_, err := s.coll.UpdateOne(
+			ctx,
+			bson.D{
+				{Key: "_id", Value: doc.ID},
+				{Key: "username_normalized", Value: bson.D{{Key: "$exists", Value: false}}},
+			},
+			bson.D{{Key: "$set", Value: bson.D{{Key: "username_normalized", Value: key}}}},
+		)
+		if err != nil {
+			if !mongo.IsDuplicateKeyError(err) {
+				return fmt.Errorf("%s: %w", op, err)
+			}
+
+			conflicts++
+			holder, err := s.usernameHolder(ctx, key)
+			if err != nil {
+				return fmt.Errorf("%s: %w", op, err)
+			}
+			sl.GetFromCtx(ctx).Error(
+				ctx,
+				"username is taken by another user",
+				slog.String("user_id", doc.ID.String()),
+				slog.String("username", doc.Username),
+				slog.String("holder_id", holder.String()),
+			)
+			continue
+		}
+		backfilled++
+	}
+	if err := cursor.Err(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	sl.GetFromCtx(ctx).Info(
+		ctx,
+		"username keys backfilled",
+		slog.Int("backfilled", backfilled),
+		slog.Int("conflicts", conflicts),
+	)
+
+	return nil
+}
+
+// releaseDeletedUserKeys frees the email and username of users soft
+// deleted before DeleteUser started releasing them. Released users no
+// longer match the filter, so it is safe to run repeatedly.
+func releaseDeletedUserKeys(ctx context.Context, s *Storage) error {
+	const op = "storage.mongo.releaseDeletedUserKeys"
+
+	filter := bson.D{
+		{Key: "deleted_at", Value: bson.D{{Key: "$exists", Value: true}}},
+		{Key: "deleted_email", Value: bson.D{{Key: "$exists", Value: false}}},
+	}
+	cursor, err := s.coll.Find(ctx, filter, options.Find().SetProjection(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var doc struct {
+			ID uuid.UUID `bson:"_id"`
+		}
+		if err := cursor.Decode(&doc); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+
+		_, err := s.coll.UpdateOne(
+			ctx,
+			append(bson.D{{Key: "_id", Value: doc.ID}}, filter...),
+			releaseKeys(doc.ID),
+		)
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+func (s *Storage) usernameHolder(ctx context.Context, key string) (uuid.UUID, error) {
+	var holder struct {
+		ID uuid.UUID `bson:"_id"`
+	}
+
+	err := s.coll.FindOne(
+		ctx,
+		bson.D{{Key: "username_normalized", Value: key}},
+		options.FindOne().SetProjection(bson.D{{Key: "_id", Value: 1}}),
+	).Decode(&holder)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	return holder.ID, nil
+}
+
+// objectKey extracts the object key from both path-style
+// (host/bucket/key) and virtual-host-style (bucket.host/key) urls.
+func objectKey(rawUrl string, bucketName string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return ""
+	}
+
+	path := strings.TrimPrefix(u.Path, "/")
+	if strings.HasPrefix(u.Host, bucketName+".") {
+		return path
+	}
+
+	return strings.TrimPrefix(path, bucketName+"/")
+}
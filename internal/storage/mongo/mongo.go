@@ -2,10 +2,12 @@ package mongo
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/AlexMickh/speak-user/internal/config"
+	errs "github.com/AlexMickh/speak-user/internal/domain/errors"
 	"github.com/AlexMickh/speak-user/internal/domain/models"
 	mongouuid "github.com/AlexMickh/speak-user/pkg/utils/mongo-uuid"
 	"github.com/AlexMickh/speak-user/pkg/utils/retry"
@@ -17,16 +19,22 @@ import (
 )
 
 type Storage struct {
-	client *mongo.Client
-	coll   *mongo.Collection
+	client  *mongo.Client
+	coll    *mongo.Collection
+	tokens  *mongo.Collection
+	outbox  *mongo.Collection
+	exports *mongo.Collection
 }
 
 func New(ctx context.Context, cfg config.DBConfig) (*Storage, error) {
 	const op = "storage.mongo.New"
 
 	var client *mongo.Client
-	var coll *mongo.Collection
+	var coll, tokens, outbox, exports *mongo.Collection
 	connString := fmt.Sprintf("mongodb://%s:%s@%s:%d/?authSource=admin", cfg.User, cfg.Password, cfg.Host, cfg.Port)
+	if cfg.DirectConnection {
+		connString += "&directConnection=true"
+	}
 
 	err := retry.WithDelay(5, 500*time.Millisecond, func() error {
 		var err error
@@ -41,19 +49,76 @@ func New(ctx context.Context, cfg config.DBConfig) (*Storage, error) {
 			return fmt.Errorf("%s: %w", op, err)
 		}
 
+		err = checkTransactions(ctx, client)
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+
 		coll = client.Database(cfg.Database).Collection(cfg.Collection)
 
-		_, err = coll.Indexes().CreateOne(
+		_, err = coll.Indexes().CreateMany(
 			ctx,
-			mongo.IndexModel{
-				Keys:    bson.D{{Key: "email", Value: 1}},
-				Options: options.Index().SetUnique(true),
+			[]mongo.IndexModel{
+				{
+					Keys:    bson.D{{Key: "email", Value: 1}},
+					Options: options.Index().SetUnique(true),
+				},
+				{
+					// Users without a username have no key. Keys of users
+					// created before usernames became unique are backfilled
+					// by a migration.
+					Keys:    bson.D{{Key: "username_normalized", Value: 1}},
+					Options: options.Index().SetUnique(true).SetSparse(true),
+				},
+				{
+					Keys:    bson.D{{Key: "deleted_at", Value: 1}},
+					Options: options.Index().SetSparse(true),
+				},
+				{
+					// Search queries must use the same collation to hit it.
+					Keys:    bson.D{{Key: "username", Value: 1}, {Key: "_id", Value: 1}},
+					Options: options.Index().SetCollation(usernameCollation),
+				},
 			},
 		)
 		if err != nil {
 			return fmt.Errorf("%s: %w", op, err)
 		}
 
+		tokens = client.Database(cfg.Database).Collection(cfg.TokensCollection)
+
+		_, err = tokens.Indexes().CreateMany(
+			ctx,
+			[]mongo.IndexModel{
+				{
+					Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "purpose", Value: 1}, {Key: "created_at", Value: -1}},
+				},
+				{
+					// Expired tokens are kept for a while so that using one
+					// reports "expired" rather than "unknown".
+					Keys:    bson.D{{Key: "expires_at", Value: 1}},
+					Options: options.Index().SetExpireAfterSeconds(tokenRetention),
+				},
+			},
+		)
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+
+		outbox = client.Database(cfg.Database).Collection(cfg.OutboxCollection)
+
+		err = createOutboxIndexes(ctx, outbox)
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+
+		exports = client.Database(cfg.Database).Collection(cfg.ExportsCollection)
+
+		err = createExportIndexes(ctx, exports)
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+
 		return nil
 	})
 	if err != nil {
@@ -61,50 +126,247 @@ func New(ctx context.Context, cfg config.DBConfig) (*Storage, error) {
 	}
 
 	return &Storage{
-		client: client,
-		coll:   coll,
+		client:  client,
+		coll:    coll,
+		tokens:  tokens,
+		outbox:  outbox,
+		exports: exports,
 	}, nil
 }
 
+// checkTransactions fails unless the server is a replica set member or a
+// mongos. Every user write runs in a transaction together with its outbox
+// event, and a standalone server can't run transactions.
+func checkTransactions(ctx context.Context, client *mongo.Client) error {
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+
+	err := client.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello)
+	if err != nil {
+		return err
+	}
+
+	if hello.SetName == "" && hello.Msg != "isdbgrid" {
+		return errors.New("mongodb is not a replica set member, transactions are unavailable: start mongod with --replSet")
+	}
+
+	return nil
+}
+
 func (s *Storage) Close(ctx context.Context) {
 	if err := s.client.Disconnect(ctx); err != nil {
 		panic(err)
 	}
 }
 
+// notDeleted leaves soft deleted users out of a filter.
+var notDeleted = bson.E{Key: "deleted_at", Value: bson.D{{Key: "$exists", Value: false}}}
+
+func activeUser(id uuid.UUID) bson.D {
+	return bson.D{{Key: "_id", Value: id}, notDeleted}
+}
+
 func (s *Storage) SaveUser(ctx context.Context, user models.User) error {
 	const op = "storage.mongo.SaveUser"
 
-	_, err := s.coll.InsertOne(ctx, user)
+	err := s.withTx(ctx, func(ctx context.Context) error {
+		_, err := s.coll.InsertOne(ctx, user)
+		if err != nil {
+			return err
+		}
+
+		return s.addEvent(ctx, models.EventUserCreated, user.ID, userCreatedPayload{
+			Email:    user.Email,
+			Username: user.Username,
+		})
+	})
 	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("%s: %w", op, duplicateKeyError(err))
+		}
 		return fmt.Errorf("%s: %w", op, err)
 	}
 
 	return nil
 }
 
+// duplicateKeyError tells which unique field a duplicate key error is
+// about.
+func duplicateKeyError(err error) error {
+	switch duplicateKeyField(err) {
+	case "username_normalized":
+		return errs.ErrUsernameTaken
+	case "email":
+		return errs.ErrEmailTaken
+	default:
+		return err
+	}
+}
+
+// duplicateKeyField returns the first field of the index a duplicate key
+// error collided on, as reported in its keyPattern. Inserts fail with a
+// WriteException, findAndModify with a CommandError.
+func duplicateKeyField(err error) string {
+	var raws []bson.Raw
+
+	var writeErr mongo.WriteException
+	if errors.As(err, &writeErr) {
+		for _, we := range writeErr.WriteErrors {
+			raws = append(raws, we.Raw)
+		}
+	}
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) {
+		raws = append(raws, cmdErr.Raw)
+	}
+
+	for _, raw := range raws {
+		pattern, ok := raw.Lookup("keyPattern").DocumentOK()
+		if !ok {
+			continue
+		}
+
+		elems, err := pattern.Elements()
+		if err != nil || len(elems) == 0 {
+			continue
+		}
+
+		return elems[0].Key()
+	}
+
+	return ""
+}
+
+// UsernameTaken reports whether some user already has the normalized
+// username key.
+func (s *Storage) UsernameTaken(ctx context.Context, key string) (bool, error) {
+	const op = "storage.mongo.UsernameTaken"
+
+	n, err := s.coll.CountDocuments(
+		ctx,
+		bson.D{{Key: "username_normalized", Value: key}},
+		options.Count().SetLimit(1),
+	)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return n > 0, nil
+}
+
 func (s *Storage) GetUser(ctx context.Context, email string) (models.User, error) {
 	const op = "storage.mongo.GetUser"
 
 	var user models.User
-	err := s.coll.FindOne(ctx, bson.D{{Key: "email", Value: email}}).Decode(&user)
+	err := s.coll.FindOne(ctx, bson.D{{Key: "email", Value: email}, notDeleted}).Decode(&user)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return models.User{}, fmt.Errorf("%s: %w", op, errs.ErrUserNotFound)
+		}
+		return models.User{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return user, nil
+}
+
+// withoutPassword leaves the password hash out of users looked up by id.
+// Only GetUser, which login goes through, needs it.
+var withoutPassword = bson.D{{Key: "password", Value: 0}}
+
+// GetUserByID returns the user without the password hash.
+func (s *Storage) GetUserByID(ctx context.Context, id uuid.UUID) (models.User, error) {
+	const op = "storage.mongo.GetUserByID"
+
+	var user models.User
+	err := s.coll.FindOne(
+		ctx,
+		activeUser(id),
+		options.FindOne().SetProjection(withoutPassword),
+	).Decode(&user)
 	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return models.User{}, fmt.Errorf("%s: %w", op, errs.ErrUserNotFound)
+		}
 		return models.User{}, fmt.Errorf("%s: %w", op, err)
 	}
 
 	return user, nil
 }
 
+// publicProfileProjection loads only the fields of models.PublicProfile,
+// so credentials and contact data never leave the database.
+var publicProfileProjection = bson.D{
+	{Key: "username", Value: 1},
+	{Key: "description", Value: 1},
+	{Key: "profile_images", Value: 1},
+	{Key: "created_at", Value: 1},
+}
+
+func (s *Storage) GetPublicProfile(ctx context.Context, id uuid.UUID) (models.PublicProfile, error) {
+	const op = "storage.mongo.GetPublicProfile"
+
+	var profile models.PublicProfile
+	err := s.coll.FindOne(
+		ctx,
+		activeUser(id),
+		options.FindOne().SetProjection(publicProfileProjection),
+	).Decode(&profile)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return models.PublicProfile{}, fmt.Errorf("%s: %w", op, errs.ErrUserNotFound)
+		}
+		return models.PublicProfile{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return profile, nil
+}
+
+// GetUsers returns the users with the given ids, without their password
+// hashes, in no particular order. Unknown ids are skipped.
+func (s *Storage) GetUsers(ctx context.Context, ids []uuid.UUID) ([]models.User, error) {
+	const op = "storage.mongo.GetUsers"
+
+	cursor, err := s.coll.Find(
+		ctx,
+		bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}, notDeleted},
+		options.Find().SetProjection(withoutPassword),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	users := make([]models.User, 0, len(ids))
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return users, nil
+}
+
 func (s *Storage) ChangeEmailVerified(ctx context.Context, id uuid.UUID) error {
 	const op = "storage.mongo.ChangeEmailVerified"
 
 	update := bson.D{
 		{Key: "$set", Value: bson.D{
 			{Key: "is_email_verified", Value: true},
+			{Key: "updated_at", Value: time.Now().Unix()},
 		}},
+		{Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}},
 	}
 
-	_, err := s.coll.UpdateByID(ctx, id, update)
+	err := s.withTx(ctx, func(ctx context.Context) error {
+		res, err := s.coll.UpdateOne(ctx, activeUser(id), update)
+		if err != nil {
+			return err
+		}
+		if res.MatchedCount == 0 {
+			return errs.ErrUserNotFound
+		}
+
+		return s.addEvent(ctx, models.EventEmailVerified, id, struct{}{})
+	})
 	if err != nil {
 		return fmt.Errorf("%s: %w", op, err)
 	}
@@ -112,55 +374,412 @@ func (s *Storage) ChangeEmailVerified(ctx context.Context, id uuid.UUID) error {
 	return nil
 }
 
-func (s *Storage) UpdateUser(
-	ctx context.Context,
-	id uuid.UUID,
-	username *string,
-	description *string,
-	profileImageUrl *string,
-) (models.User, error) {
-	const op = "storage.mongo.UpdateUser"
+func (s *Storage) SetPendingEmail(ctx context.Context, id uuid.UUID, email string) error {
+	const op = "storage.mongo.SetPendingEmail"
 
-	data := struct {
-		Username        *string `bson:"username,omitempty" json:"username,omitempty"`
-		Description     *string `bson:"description,omitempty" json:"description,omitempty"`
-		ProfileImageUrl *string `bson:"profile_image_url,omitempty" json:"profile_image_url,omitempty"`
-	}{
-		Username:        username,
-		Description:     description,
-		ProfileImageUrl: profileImageUrl,
+	update := bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: "pending_email", Value: email},
+		}},
+	}
+
+	res, err := s.coll.UpdateOne(ctx, activeUser(id), update)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("%s: %w", op, errs.ErrUserNotFound)
 	}
+
+	return nil
+}
+
+// ChangeEmail replaces the email with the pending one. The new address is
+// considered verified, since confirming the change proves access to it.
+// If a newer request replaced the pending email, the change is refused.
+func (s *Storage) ChangeEmail(ctx context.Context, id uuid.UUID, email string) error {
+	const op = "storage.mongo.ChangeEmail"
+
 	update := bson.D{
-		{Key: "$set", Value: data},
+		{Key: "$set", Value: bson.D{
+			{Key: "email", Value: email},
+			{Key: "is_email_verified", Value: true},
+			{Key: "updated_at", Value: time.Now().Unix()},
+		}},
+		{Key: "$unset", Value: bson.D{
+			{Key: "pending_email", Value: ""},
+		}},
+		{Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}},
 	}
 
-	_, err := s.coll.UpdateByID(ctx, id, update)
+	err := s.withTx(ctx, func(ctx context.Context) error {
+		var user models.User
+		err := s.coll.FindOneAndUpdate(
+			ctx,
+			bson.D{{Key: "_id", Value: id}, {Key: "pending_email", Value: email}, notDeleted},
+			update,
+			options.FindOneAndUpdate().SetReturnDocument(options.After),
+		).Decode(&user)
+		if err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				return errs.ErrTokenNotFound
+			}
+			return err
+		}
+
+		return s.addEvent(ctx, models.EventProfileUpdated, id, newProfileUpdatedPayload(user))
+	})
 	if err != nil {
-		return models.User{}, fmt.Errorf("%s: %w", op, err)
+		if mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("%s: %w", op, errs.ErrEmailTaken)
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+func (s *Storage) UpdatePassword(ctx context.Context, id uuid.UUID, password string) error {
+	const op = "storage.mongo.UpdatePassword"
+
+	update := bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: "password", Value: password},
+			{Key: "updated_at", Value: time.Now().Unix()},
+		}},
+	}
+
+	res, err := s.coll.UpdateOne(ctx, activeUser(id), update)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("%s: %w", op, errs.ErrUserNotFound)
+	}
+
+	return nil
+}
+
+func (s *Storage) GetProfileImages(ctx context.Context, id uuid.UUID) (map[string]string, error) {
+	const op = "storage.mongo.GetProfileImages"
+
+	var user models.User
+	err := s.coll.FindOne(
+		ctx,
+		activeUser(id),
+		options.FindOne().SetProjection(bson.D{{Key: "profile_images", Value: 1}}),
+	).Decode(&user)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, fmt.Errorf("%s: %w", op, errs.ErrUserNotFound)
+		}
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return user.ProfileImages, nil
+}
+
+// ReferencedImageKeys returns every object key some user points at.
+func (s *Storage) ReferencedImageKeys(ctx context.Context) (map[string]struct{}, error) {
+	const op = "storage.mongo.ReferencedImageKeys"
+
+	cursor, err := s.coll.Find(
+		ctx,
+		bson.D{{Key: "profile_images", Value: bson.D{{Key: "$exists", Value: true}}}},
+		options.Find().SetProjection(bson.D{{Key: "profile_images", Value: 1}}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer cursor.Close(ctx)
+
+	keys := make(map[string]struct{})
+	for cursor.Next(ctx) {
+		var user models.User
+		if err := cursor.Decode(&user); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+
+		for _, key := range user.ProfileImages {
+			keys[key] = struct{}{}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return keys, nil
+}
+
+// UsersWithOriginalAvatars returns up to limit users whose avatar is still
+// the object as it was uploaded, leaving out those whose original was
+// marked with SkipOriginalAvatar. Only the id, avatar and version are set.
+func (s *Storage) UsersWithOriginalAvatars(ctx context.Context, limit int) ([]models.User, error) {
+	const op = "storage.mongo.UsersWithOriginalAvatars"
+
+	cursor, err := s.coll.Find(
+		ctx,
+		bson.D{
+			{Key: "profile_images.original", Value: bson.D{{Key: "$exists", Value: true}}},
+			{Key: "$expr", Value: bson.D{{Key: "$ne", Value: bson.A{"$skipped_avatar", "$profile_images.original"}}}},
+			notDeleted,
+		},
+		options.Find().
+			SetProjection(bson.D{{Key: "profile_images", Value: 1}, {Key: "version", Value: 1}}).
+			SetLimit(int64(limit)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var users []models.User
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return users, nil
+}
+
+// SkipOriginalAvatar remembers that the original avatar key can't be
+// processed, so UsersWithOriginalAvatars stops returning the user until
+// the avatar changes. The user itself is left untouched.
+func (s *Storage) SkipOriginalAvatar(ctx context.Context, id uuid.UUID, key string) error {
+	const op = "storage.mongo.SkipOriginalAvatar"
+
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "skipped_avatar", Value: key}}}}
+
+	res, err := s.coll.UpdateOne(ctx, activeUser(id), update)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if res.MatchedCount == 0 {
+		return fmt.Errorf("%s: %w", op, errs.ErrUserNotFound)
+	}
+
+	return nil
+}
+
+// UpdateUser applies data atomically and returns the user as this very
+// update left it. With data.ExpectedVersion set, a user at any other
+// version is left alone and ErrVersionConflict is returned.
+func (s *Storage) UpdateUser(ctx context.Context, id uuid.UUID, data models.UserUpdate) (models.User, error) {
+	const op = "storage.mongo.UpdateUser"
+
+	filter := activeUser(id)
+	if data.ExpectedVersion != nil {
+		filter = append(filter, versionFilter(*data.ExpectedVersion))
+	}
+
+	data.UpdatedAt = time.Now().Unix()
+	update := bson.D{{Key: "$set", Value: data}}
+	if !data.KeepVersion {
+		update = append(update, bson.E{Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}})
+	}
+	if len(data.Unset) > 0 {
+		unset := make(bson.D, 0, len(data.Unset))
+		for _, field := range data.Unset {
+			unset = append(unset, bson.E{Key: field, Value: ""})
+		}
+		update = append(update, bson.E{Key: "$unset", Value: unset})
 	}
 
 	var user models.User
-	err = s.coll.FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&user)
+	err := s.withTx(ctx, func(ctx context.Context) error {
+		err := s.coll.FindOneAndUpdate(
+			ctx,
+			filter,
+			update,
+			options.FindOneAndUpdate().SetReturnDocument(options.After),
+		).Decode(&user)
+		if err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				return s.updateMissError(ctx, id, data.ExpectedVersion)
+			}
+			return err
+		}
+
+		return s.addEvent(ctx, models.EventProfileUpdated, id, newProfileUpdatedPayload(user))
+	})
 	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return models.User{}, fmt.Errorf("%s: %w", op, duplicateKeyError(err))
+		}
 		return models.User{}, fmt.Errorf("%s: %w", op, err)
 	}
 
 	return user, nil
 }
 
-func (s *Storage) DeleteUser(ctx context.Context, id uuid.UUID) (string, error) {
+// versionFilter matches users at version. Users created before versioning
+// have no version field and count as version 0.
+func versionFilter(version int64) bson.E {
+	if version == 0 {
+		return bson.E{Key: "version", Value: bson.D{{Key: "$in", Value: bson.A{0, nil}}}}
+	}
+
+	return bson.E{Key: "version", Value: version}
+}
+
+// updateMissError tells why a versioned update matched nothing: the user
+// is gone or it has moved on to another version.
+func (s *Storage) updateMissError(ctx context.Context, id uuid.UUID, expectedVersion *int64) error {
+	if expectedVersion == nil {
+		return errs.ErrUserNotFound
+	}
+
+	n, err := s.coll.CountDocuments(ctx, activeUser(id), options.Count().SetLimit(1))
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errs.ErrUserNotFound
+	}
+
+	return errs.ErrVersionConflict
+}
+
+// DeleteUser soft deletes the user. The document stays until it is purged,
+// but every other read and write treats the user as gone.
+func (s *Storage) DeleteUser(ctx context.Context, id uuid.UUID) error {
 	const op = "storage.mongo.DeleteUser"
 
-	var user models.User
-	err := s.coll.FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&user)
+	now := time.Now().Unix()
+	update := releaseKeys(id, bson.E{Key: "deleted_at", Value: now}, bson.E{Key: "updated_at", Value: now})
+
+	err := s.withTx(ctx, func(ctx context.Context) error {
+		res, err := s.coll.UpdateOne(ctx, activeUser(id), update)
+		if err != nil {
+			return err
+		}
+		if res.MatchedCount == 0 {
+			return errs.ErrUserNotFound
+		}
+
+		return s.addEvent(ctx, models.EventUserDeleted, id, struct{}{})
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// releaseKeys is a pipeline update that moves the unique keys of a user
+// aside along with setting fields, so a soft deleted user doesn't keep
+// its email and username from others. The email index isn't sparse, so
+// the email is replaced with one unique to the user rather than removed.
+func releaseKeys(id uuid.UUID, fields ...bson.E) mongo.Pipeline {
+	set := bson.D{
+		{Key: "deleted_email", Value: "$email"},
+		{Key: "deleted_username_normalized", Value: "$username_normalized"},
+		{Key: "email", Value: id.String() + "@deleted.invalid"},
+	}
+	set = append(set, fields...)
+
+	return mongo.Pipeline{
+		{{Key: "$set", Value: set}},
+		{{Key: "$unset", Value: "username_normalized"}},
+	}
+}
+
+// restoredKey takes field back from its deleted_ copy. Users deleted
+// before keys were released still have the field itself and keep it.
+func restoredKey(field string) bson.D {
+	return bson.D{{Key: "$cond", Value: bson.A{
+		bson.D{{Key: "$eq", Value: bson.A{bson.D{{Key: "$type", Value: "$deleted_" + field}}, "missing"}}},
+		"$" + field,
+		"$deleted_" + field,
+	}}}
+}
+
+// RestoreUser undoes a soft delete made at deletedAfter or later. The
+// released email and username are taken back, and ErrEmailTaken or
+// ErrUsernameTaken is returned if someone else took them meanwhile.
+func (s *Storage) RestoreUser(ctx context.Context, id uuid.UUID, deletedAfter int64) error {
+	const op = "storage.mongo.RestoreUser"
+
+	filter := bson.D{
+		{Key: "_id", Value: id},
+		{Key: "deleted_at", Value: bson.D{{Key: "$gte", Value: deletedAfter}}},
+	}
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.D{
+			{Key: "email", Value: restoredKey("email")},
+			{Key: "username_normalized", Value: restoredKey("username_normalized")},
+			{Key: "updated_at", Value: time.Now().Unix()},
+		}}},
+		{{Key: "$unset", Value: bson.A{"deleted_at", "deleted_email", "deleted_username_normalized"}}},
+	}
+
+	err := s.withTx(ctx, func(ctx context.Context) error {
+		res, err := s.coll.UpdateOne(ctx, filter, update)
+		if err != nil {
+			return err
+		}
+		if res.MatchedCount == 0 {
+			return errs.ErrUserNotFound
+		}
+
+		return s.addEvent(ctx, models.EventUserRestored, id, struct{}{})
+	})
 	if err != nil {
-		return "", fmt.Errorf("%s: %w", op, err)
+		if mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("%s: %w", op, duplicateKeyError(err))
+		}
+		return fmt.Errorf("%s: %w", op, err)
 	}
 
-	_, err = s.coll.DeleteOne(ctx, bson.D{{Key: "_id", Value: id}})
+	return nil
+}
+
+// DeletedUsers returns up to limit users soft deleted before the given
+// time.
+func (s *Storage) DeletedUsers(ctx context.Context, deletedBefore int64, limit int) ([]uuid.UUID, error) {
+	const op = "storage.mongo.DeletedUsers"
+
+	cursor, err := s.coll.Find(
+		ctx,
+		bson.D{{Key: "deleted_at", Value: bson.D{{Key: "$lt", Value: deletedBefore}}}},
+		options.Find().SetProjection(bson.D{{Key: "_id", Value: 1}}).SetLimit(int64(limit)),
+	)
 	if err != nil {
-		return "", fmt.Errorf("%s: %w", op, err)
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var docs []struct {
+		ID uuid.UUID `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	ids := make([]uuid.UUID, 0, len(docs))
+	for _, doc := range docs {
+		ids = append(ids, doc.ID)
+	}
+
+	return ids, nil
+}
+
+// PurgeUser removes a user soft deleted before the given time for good
+// and returns the keys of the avatar it had. Users restored in the
+// meantime are left alone.
+func (s *Storage) PurgeUser(ctx context.Context, id uuid.UUID, deletedBefore int64) (map[string]string, error) {
+	const op = "storage.mongo.PurgeUser"
+
+	filter := bson.D{
+		{Key: "_id", Value: id},
+		{Key: "deleted_at", Value: bson.D{{Key: "$lt", Value: deletedBefore}}},
+	}
+
+	var user models.User
+	err := s.coll.FindOneAndDelete(ctx, filter).Decode(&user)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, fmt.Errorf("%s: %w", op, errs.ErrUserNotFound)
+		}
+		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
-	return *user.ProfileImageUrl, nil
+	return user.ProfileImages, nil
 }
@@ -0,0 +1,153 @@
+package mongo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/AlexMickh/speak-user/internal/domain/models"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// outboxRetention is how long, in seconds, published events are kept.
+const outboxRetention = int32(7 * 24 * 60 * 60)
+
+type userCreatedPayload struct {
+	Email    string  `json:"email"`
+	Username *string `json:"username,omitempty"`
+}
+
+type profileUpdatedPayload struct {
+	Email         string            `json:"email"`
+	Username      *string           `json:"username,omitempty"`
+	Description   *string           `json:"description,omitempty"`
+	ProfileImages map[string]string `json:"profile_images,omitempty"`
+	Version       int64             `json:"version"`
+}
+
+func newProfileUpdatedPayload(user models.User) profileUpdatedPayload {
+	return profileUpdatedPayload{
+		Email:         user.Email,
+		Username:      user.Username,
+		Description:   user.Description,
+		ProfileImages: user.ProfileImages,
+		Version:       user.Version,
+	}
+}
+
+func createOutboxIndexes(ctx context.Context, outbox *mongo.Collection) error {
+	_, err := outbox.Indexes().CreateMany(
+		ctx,
+		[]mongo.IndexModel{
+			{
+				Keys: bson.D{{Key: "published_at", Value: 1}, {Key: "created_at", Value: 1}},
+			},
+			{
+				Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: 1}},
+			},
+			{
+				Keys:    bson.D{{Key: "published_at", Value: 1}},
+				Options: options.Index().SetExpireAfterSeconds(outboxRetention).SetName("published_at_ttl"),
+			},
+		},
+	)
+
+	return err
+}
+
+// withTx runs fn in a transaction, so a user change and its outbox event
+// are written together or not at all. Transactions need a replica set.
+func (s *Storage) withTx(ctx context.Context, fn func(ctx context.Context) error) error {
+	session, err := s.client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(ctx context.Context) (any, error) {
+		return nil, fn(ctx)
+	})
+
+	return err
+}
+
+func (s *Storage) addEvent(ctx context.Context, eventType string, userID uuid.UUID, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.outbox.InsertOne(ctx, models.Event{
+		ID:        uuid.New(),
+		Type:      eventType,
+		UserID:    userID,
+		Payload:   data,
+		CreatedAt: time.Now(),
+	})
+
+	return err
+}
+
+// UnpublishedEvents returns up to limit events in the order they happened.
+func (s *Storage) UnpublishedEvents(ctx context.Context, limit int) ([]models.Event, error) {
+	const op = "storage.mongo.UnpublishedEvents"
+
+	cursor, err := s.outbox.Find(
+		ctx,
+		bson.D{{Key: "published_at", Value: nil}},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}).SetLimit(int64(limit)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var events []models.Event
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return events, nil
+}
+
+func (s *Storage) MarkEventPublished(ctx context.Context, id uuid.UUID) error {
+	const op = "storage.mongo.MarkEventPublished"
+
+	update := bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: "published_at", Value: time.Now()},
+		}},
+	}
+
+	_, err := s.outbox.UpdateByID(ctx, id, update)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// UserEvents returns the events of one user still kept in the outbox, in
+// the order they happened.
+func (s *Storage) UserEvents(ctx context.Context, userID uuid.UUID) ([]models.Event, error) {
+	const op = "storage.mongo.UserEvents"
+
+	cursor, err := s.outbox.Find(
+		ctx,
+		bson.D{{Key: "user_id", Value: userID}},
+		options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var events []models.Event
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return events, nil
+}
@@ -0,0 +1,68 @@
+package mongo
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/AlexMickh/speak-user/internal/domain/models"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// usernameCollation compares usernames ignoring case.
+var usernameCollation = &options.Collation{
+	Locale:   "en",
+	Strength: 2,
+}
+
+// prefixEnd sorts after every string starting with a prefix. CLDR gives
+// U+FFFF the highest primary weight for exactly this purpose.
+const prefixEnd = "\uffff"
+
+// SearchUsers returns up to limit verified users whose username starts
+// with prefix, ordered by username and then id. When after is set the
+// page starts right behind it.
+func (s *Storage) SearchUsers(
+	ctx context.Context,
+	prefix string,
+	after *models.SearchCursor,
+	limit int,
+) ([]models.PublicProfile, error) {
+	const op = "storage.mongo.SearchUsers"
+
+	filter := bson.D{
+		{Key: "username", Value: bson.D{
+			{Key: "$gte", Value: prefix},
+			{Key: "$lt", Value: prefix + prefixEnd},
+		}},
+		{Key: "is_email_verified", Value: true},
+		notDeleted,
+	}
+	if after != nil {
+		filter = append(filter, bson.E{Key: "$or", Value: bson.A{
+			bson.D{{Key: "username", Value: bson.D{{Key: "$gt", Value: after.Username}}}},
+			bson.D{
+				{Key: "username", Value: after.Username},
+				{Key: "_id", Value: bson.D{{Key: "$gt", Value: after.ID}}},
+			},
+		}})
+	}
+
+	opts := options.Find().
+		SetCollation(usernameCollation).
+		SetSort(bson.D{{Key: "username", Value: 1}, {Key: "_id", Value: 1}}).
+		SetLimit(int64(limit)).
+		SetProjection(publicProfileProjection)
+
+	cursor, err := s.coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	profiles := make([]models.PublicProfile, 0, limit)
+	if err := cursor.All(ctx, &profiles); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return profiles, nil
+}
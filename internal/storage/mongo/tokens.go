@@ -0,0 +1,107 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	errs "github.com/AlexMickh/speak-user/internal/domain/errors"
+	"github.com/AlexMickh/speak-user/internal/domain/models"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// tokenRetention is how long, in seconds, a token document outlives its
+// expiry before the TTL monitor removes it.
+const tokenRetention = int32(7 * 24 * 60 * 60)
+
+// SaveVerificationToken stores token and drops unused tokens issued earlier
+// for the same user and purpose, so only the latest one works.
+func (s *Storage) SaveVerificationToken(ctx context.Context, token models.VerificationToken) error {
+	const op = "storage.mongo.SaveVerificationToken"
+
+	_, err := s.tokens.DeleteMany(ctx, bson.D{
+		{Key: "user_id", Value: token.UserID},
+		{Key: "purpose", Value: token.Purpose},
+		{Key: "used_at", Value: bson.D{{Key: "$exists", Value: false}}},
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	_, err = s.tokens.InsertOne(ctx, token)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+func (s *Storage) LastVerificationToken(
+	ctx context.Context,
+	userID uuid.UUID,
+	purpose string,
+) (models.VerificationToken, error) {
+	const op = "storage.mongo.LastVerificationToken"
+
+	var token models.VerificationToken
+	err := s.tokens.FindOne(
+		ctx,
+		bson.D{{Key: "user_id", Value: userID}, {Key: "purpose", Value: purpose}},
+		options.FindOne().SetSort(bson.D{{Key: "created_at", Value: -1}}),
+	).Decode(&token)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return models.VerificationToken{}, fmt.Errorf("%s: %w", op, errs.ErrTokenNotFound)
+		}
+		return models.VerificationToken{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return token, nil
+}
+
+// UseVerificationToken atomically marks the token as used. When that is not
+// possible it tells apart unknown, already used and expired tokens.
+func (s *Storage) UseVerificationToken(
+	ctx context.Context,
+	hash string,
+	purpose string,
+) (models.VerificationToken, error) {
+	const op = "storage.mongo.UseVerificationToken"
+
+	now := time.Now()
+
+	var token models.VerificationToken
+	err := s.tokens.FindOneAndUpdate(
+		ctx,
+		bson.D{
+			{Key: "_id", Value: hash},
+			{Key: "purpose", Value: purpose},
+			{Key: "used_at", Value: bson.D{{Key: "$exists", Value: false}}},
+			{Key: "expires_at", Value: bson.D{{Key: "$gt", Value: now}}},
+		},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "used_at", Value: now}}}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&token)
+	if err == nil {
+		return token, nil
+	}
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return models.VerificationToken{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	err = s.tokens.FindOne(ctx, bson.D{{Key: "_id", Value: hash}, {Key: "purpose", Value: purpose}}).Decode(&token)
+	switch {
+	case errors.Is(err, mongo.ErrNoDocuments):
+		return models.VerificationToken{}, fmt.Errorf("%s: %w", op, errs.ErrTokenNotFound)
+	case err != nil:
+		return models.VerificationToken{}, fmt.Errorf("%s: %w", op, err)
+	case token.UsedAt != nil:
+		return models.VerificationToken{}, fmt.Errorf("%s: %w", op, errs.ErrTokenUsed)
+	default:
+		return models.VerificationToken{}, fmt.Errorf("%s: %w", op, errs.ErrTokenExpired)
+	}
+}
@@ -0,0 +1,103 @@
+package mongo
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+
+	errs "github.com/AlexMickh/speak-user/internal/domain/errors"
+	"github.com/AlexMickh/speak-user/internal/domain/models"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+var changeOperations = map[string]string{
+	"insert":  models.ChangeCreated,
+	"update":  models.ChangeUpdated,
+	"replace": models.ChangeUpdated,
+	"delete":  models.ChangeDeleted,
+}
+
+// WatchUsers streams changes of the users collection to fn until ctx is
+// done or fn fails. Only changes of ids are reported when ids is not
+// empty. Sensitive fields are projected out on the server, so they never
+// reach this process. Change streams need a replica set.
+func (s *Storage) WatchUsers(
+	ctx context.Context,
+	ids []uuid.UUID,
+	resumeToken string,
+	fn func(change models.UserChange) error,
+) error {
+	const op = "storage.mongo.WatchUsers"
+
+	match := bson.D{
+		{Key: "operationType", Value: bson.D{{Key: "$in", Value: bson.A{"insert", "update", "replace", "delete"}}}},
+	}
+	if len(ids) > 0 {
+		match = append(match, bson.E{Key: "documentKey._id", Value: bson.D{{Key: "$in", Value: ids}}})
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$project", Value: bson.D{
+			{Key: "updateDescription", Value: 0},
+			{Key: "fullDocument.password", Value: 0},
+			{Key: "fullDocument.pending_email", Value: 0},
+		}}},
+	}
+
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	if resumeToken != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(resumeToken)
+		if err != nil {
+			return fmt.Errorf("%s: %w", op, errs.ErrInvalidResumeToken)
+		}
+		opts.SetResumeAfter(bson.Raw(raw))
+	}
+
+	stream, err := s.coll.Watch(ctx, pipeline, opts)
+	if err != nil {
+		if resumeToken != "" {
+			return fmt.Errorf("%s: %w: %w", op, errs.ErrInvalidResumeToken, err)
+		}
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer stream.Close(context.WithoutCancel(ctx))
+
+	for stream.Next(ctx) {
+		var event struct {
+			OperationType string `bson:"operationType"`
+			DocumentKey   struct {
+				ID uuid.UUID `bson:"_id"`
+			} `bson:"documentKey"`
+			FullDocument *models.User `bson:"fullDocument"`
+		}
+		if err := stream.Decode(&event); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+
+		change := models.UserChange{
+			Operation:   changeOperations[event.OperationType],
+			UserID:      event.DocumentKey.ID,
+			User:        event.FullDocument,
+			ResumeToken: base64.RawURLEncoding.EncodeToString(stream.ResumeToken()),
+		}
+		if change.User != nil && change.User.DeletedAt != 0 {
+			change.Operation = models.ChangeDeleted
+		}
+		if change.Operation == models.ChangeDeleted {
+			change.User = nil
+		}
+
+		if err := fn(change); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+	}
+	if err := stream.Err(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
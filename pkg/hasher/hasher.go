@@ -0,0 +1,203 @@
+package hasher
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrMismatch      = errors.New("password does not match hash")
+	ErrUnknownFormat = errors.New("unknown hash format")
+)
+
+type Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// Hasher hashes new passwords with argon2id and verifies both argon2id
+// and legacy bcrypt hashes, as well as plaintext passwords stored before
+// passwords were hashed at all.
+type Hasher struct {
+	params Params
+}
+
+func New(params Params) *Hasher {
+	return &Hasher{
+		params: params,
+	}
+}
+
+func (h *Hasher) Hash(password string) (string, error) {
+	const op = "hasher.Hash"
+
+	salt := make([]byte, h.params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	key := argon2.IDKey(
+		[]byte(password),
+		salt,
+		h.params.Iterations,
+		h.params.Memory,
+		h.params.Parallelism,
+		h.params.KeyLength,
+	)
+
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		h.params.Memory,
+		h.params.Iterations,
+		h.params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// Verify checks password against hash. needsRehash is true when the hash
+// was produced by bcrypt or with argon2id parameters different from the
+// current ones, or when it is no hash but a legacy plaintext password.
+// Values that look like a hash of a format Verify doesn't know are
+// rejected with ErrUnknownFormat rather than compared as plaintext, so
+// such a hash can't be used as the password itself.
+func (h *Hasher) Verify(password string, hash string) (needsRehash bool, err error) {
+	const op = "hasher.Verify"
+
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		needsRehash, err = h.verifyArgon2id(password, hash)
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			err = ErrMismatch
+		}
+		needsRehash = true
+	case looksLikeHash(hash):
+		err = ErrUnknownFormat
+	default:
+		err = verifyPlaintext(password, hash)
+		needsRehash = true
+	}
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return needsRehash, nil
+}
+
+func (h *Hasher) verifyArgon2id(password string, hash string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false, ErrUnknownFormat
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return false, ErrUnknownFormat
+	}
+	if version != argon2.Version {
+		return false, ErrUnknownFormat
+	}
+
+	var params Params
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+	if err != nil {
+		return false, ErrUnknownFormat
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, ErrUnknownFormat
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, ErrUnknownFormat
+	}
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+
+	otherKey := argon2.IDKey(
+		[]byte(password),
+		salt,
+		params.Iterations,
+		params.Memory,
+		params.Parallelism,
+		params.KeyLength,
+	)
+	if subtle.ConstantTimeCompare(key, otherKey) != 1 {
+		return false, ErrMismatch
+	}
+
+	return params != h.params, nil
+}
+
+// looksLikeHash reports whether stored may be a hash in a format Verify
+// doesn't know: a modular crypt string or a hex digest of a common size.
+func looksLikeHash(stored string) bool {
+	if strings.HasPrefix(stored, "$") {
+		return true
+	}
+
+	switch len(stored) {
+	case 32, 40, 56, 64, 96, 128:
+	default:
+		return false
+	}
+	for _, c := range stored {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// verifyPlaintext compares digests rather than the passwords themselves,
+// so the time taken doesn't reveal the length of the stored one either.
+func verifyPlaintext(password string, stored string) error {
+	if stored == "" {
+		return ErrMismatch
+	}
+
+	want := sha256.Sum256([]byte(stored))
+	got := sha256.Sum256([]byte(password))
+	if subtle.ConstantTimeCompare(want[:], got[:]) != 1 {
+		return ErrMismatch
+	}
+
+	return nil
+}
+
+// Plaintext stores new passwords as they are while still verifying
+// everything Hasher does. It is for deployments whose login compares
+// the password returned by GetUser itself and so can't handle hashes yet.
+type Plaintext struct {
+	*Hasher
+}
+
+func (p Plaintext) Hash(password string) (string, error) {
+	return password, nil
+}
+
+// Verify never asks for a rehash, so stored passwords keep the format
+// the login side understands.
+func (p Plaintext) Verify(password string, hash string) (bool, error) {
+	if _, err := p.Hasher.Verify(password, hash); err != nil {
+		return false, err
+	}
+
+	return false, nil
+}
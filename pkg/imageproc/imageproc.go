@@ -0,0 +1,154 @@
+package imageproc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/webp"
+)
+
+var (
+	ErrTooLarge          = errors.New("image is too large")
+	ErrUnsupportedFormat = errors.New("unsupported image format")
+)
+
+const ContentType = "image/png"
+
+// ContentTypes lists the formats accepted for uploads.
+var ContentTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp"}
+
+type Variant struct {
+	Size int
+	Data []byte
+}
+
+// Processor turns an uploaded picture into square PNG variants. Decoding
+// and re-encoding drops EXIF and any other metadata from the original.
+type Processor struct {
+	maxBytes  int64
+	maxPixels int
+	sizes     []int
+}
+
+func New(maxBytes int64, maxPixels int, sizes []int) *Processor {
+	return &Processor{
+		maxBytes:  maxBytes,
+		maxPixels: maxPixels,
+		sizes:     sizes,
+	}
+}
+
+func (p *Processor) MaxBytes() int64 {
+	return p.maxBytes
+}
+
+func (p *Processor) Process(data []byte) ([]Variant, error) {
+	const op = "imageproc.Process"
+
+	if int64(len(data)) > p.maxBytes {
+		return nil, fmt.Errorf("%s: %w", op, ErrTooLarge)
+	}
+
+	decode, decodeConfig, err := codec(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	// Check dimensions before decoding so a small file cannot expand into
+	// a huge bitmap.
+	cfg, err := decodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, ErrUnsupportedFormat)
+	}
+	if cfg.Width*cfg.Height > p.maxPixels {
+		return nil, fmt.Errorf("%s: %w", op, ErrTooLarge)
+	}
+
+	img, err := decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, ErrUnsupportedFormat)
+	}
+
+	square := cropSquare(img)
+
+	variants := make([]Variant, 0, len(p.sizes))
+	for _, size := range p.sizes {
+		dst := image.NewNRGBA(image.Rect(0, 0, size, size))
+		draw.CatmullRom.Scale(dst, dst.Bounds(), square, square.Bounds(), draw.Over, nil)
+
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, dst); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+
+		variants = append(variants, Variant{
+			Size: size,
+			Data: buf.Bytes(),
+		})
+	}
+
+	return variants, nil
+}
+
+// ValidateStream checks a streamed upload that cannot be decoded up front.
+// header must hold the first bytes of the image, 512 are enough to sniff
+// any supported format.
+func (p *Processor) ValidateStream(contentType string, size int64, header []byte) error {
+	const op = "imageproc.ValidateStream"
+
+	if size <= 0 || size > p.maxBytes {
+		return fmt.Errorf("%s: %w", op, ErrTooLarge)
+	}
+
+	if _, _, err := codec(header); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if http.DetectContentType(header) != contentType {
+		return fmt.Errorf("%s: %w", op, ErrUnsupportedFormat)
+	}
+
+	return nil
+}
+
+type (
+	decodeFunc       func(r io.Reader) (image.Image, error)
+	decodeConfigFunc func(r io.Reader) (image.Config, error)
+)
+
+// codec picks a decoder by the sniffed content type, ignoring whatever the
+// client claims the file is.
+func codec(data []byte) (decodeFunc, decodeConfigFunc, error) {
+	switch http.DetectContentType(data) {
+	case "image/png":
+		return png.Decode, png.DecodeConfig, nil
+	case "image/jpeg":
+		return jpeg.Decode, jpeg.DecodeConfig, nil
+	case "image/gif":
+		return gif.Decode, gif.DecodeConfig, nil
+	case "image/webp":
+		return webp.Decode, webp.DecodeConfig, nil
+	default:
+		return nil, nil, ErrUnsupportedFormat
+	}
+}
+
+func cropSquare(img image.Image) image.Image {
+	b := img.Bounds()
+
+	side := min(b.Dx(), b.Dy())
+	x := b.Min.X + (b.Dx()-side)/2
+	y := b.Min.Y + (b.Dy()-side)/2
+
+	dst := image.NewNRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(dst, dst.Bounds(), img, image.Pt(x, y), draw.Src)
+
+	return dst
+}
@@ -0,0 +1,150 @@
+package username
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+var (
+	ErrLength       = errors.New("username length is out of range")
+	ErrInvalidChars = errors.New("username contains forbidden characters")
+	ErrMixedScript  = errors.New("username mixes scripts")
+	ErrReserved     = errors.New("username is reserved")
+)
+
+const (
+	MinLength = 3
+	MaxLength = 32
+)
+
+// reserved names can't be taken by anyone, whatever their case or look.
+var reserved = []string{
+	"admin",
+	"administrator",
+	"api",
+	"help",
+	"me",
+	"moderator",
+	"null",
+	"official",
+	"root",
+	"speak",
+	"support",
+	"system",
+	"undefined",
+}
+
+// confusables maps letters that look like latin ones to those latin
+// letters. It covers the cyrillic and greek lookalikes, which are what
+// impersonation attempts use in practice.
+var confusables = map[rune]rune{
+	'а': 'a', 'в': 'b', 'е': 'e', 'ё': 'e', 'к': 'k', 'м': 'm', 'н': 'h',
+	'о': 'o', 'р': 'p', 'с': 'c', 'т': 't', 'у': 'y', 'х': 'x', 'і': 'i',
+	'ј': 'j', 'ѕ': 's', 'һ': 'h', 'ԁ': 'd', 'ԛ': 'q', 'ԝ': 'w',
+	'α': 'a', 'β': 'b', 'ε': 'e', 'η': 'n', 'ι': 'i', 'κ': 'k', 'ν': 'v',
+	'ο': 'o', 'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x', 'γ': 'y',
+}
+
+// scripts names the script of every allowed letter. Japanese names mix
+// kanji and kana, so those share one name.
+var scripts = []struct {
+	name  string
+	table *unicode.RangeTable
+}{
+	{name: "latin", table: unicode.Latin},
+	{name: "cyrillic", table: unicode.Cyrillic},
+	{name: "greek", table: unicode.Greek},
+	{name: "cjk", table: unicode.Han},
+	{name: "cjk", table: unicode.Hiragana},
+	{name: "cjk", table: unicode.Katakana},
+	{name: "hangul", table: unicode.Hangul},
+	{name: "arabic", table: unicode.Arabic},
+	{name: "hebrew", table: unicode.Hebrew},
+}
+
+var folder = cases.Fold()
+
+// Normalize checks a username and returns its display form and its key.
+// The display form is the NFKC normalized input. The key is additionally
+// case folded and has lookalike letters replaced with latin ones, so two
+// usernames that read the same get the same key. Uniqueness is enforced
+// on keys.
+func Normalize(username string) (display string, key string, err error) {
+	const op = "username.Normalize"
+
+	display = norm.NFKC.String(strings.TrimSpace(username))
+
+	if n := utf8.RuneCountInString(display); n < MinLength || n > MaxLength {
+		return "", "", fmt.Errorf("%s: %w", op, ErrLength)
+	}
+
+	if err := validate(display); err != nil {
+		return "", "", fmt.Errorf("%s: %w", op, err)
+	}
+
+	key = Key(display)
+	for _, name := range reserved {
+		if key == name {
+			return "", "", fmt.Errorf("%s: %w", op, ErrReserved)
+		}
+	}
+
+	return display, key, nil
+}
+
+// Key returns the uniqueness key of an already normalized username.
+func Key(display string) string {
+	folded := norm.NFKC.String(folder.String(display))
+
+	return strings.Map(func(r rune) rune {
+		if latin, ok := confusables[r]; ok {
+			return latin
+		}
+		return r
+	}, folded)
+}
+
+// validate allows letters of a single script, digits and the separators
+// '.', '_' and '-', which may not start or end the name.
+func validate(display string) error {
+	script := ""
+
+	for i, r := range display {
+		switch {
+		case r == '.' || r == '_' || r == '-':
+			if i == 0 || i+utf8.RuneLen(r) == len(display) {
+				return ErrInvalidChars
+			}
+		case unicode.IsDigit(r):
+		case unicode.IsLetter(r):
+			s := scriptOf(r)
+			if s == "" {
+				return ErrInvalidChars
+			}
+			if script != "" && s != script {
+				return ErrMixedScript
+			}
+			script = s
+		default:
+			return ErrInvalidChars
+		}
+	}
+
+	return nil
+}
+
+func scriptOf(r rune) string {
+	for _, s := range scripts {
+		if unicode.Is(s.table, r) {
+			return s.name
+		}
+	}
+
+	return ""
+}